@@ -8,17 +8,20 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/kaijchen/cafs/config"
+	"github.com/kaijchen/cafs/layout"
 	"github.com/kaijchen/cafs/location"
 	"github.com/kaijchen/cafs/metadata"
 	"github.com/kaijchen/cafs/platform"
@@ -32,82 +35,125 @@ func errno(err error) int {
 	}
 }
 
+// roPool is a pool only read from, in its own layout.
+type roPool struct {
+	dir    string
+	layout layout.Layout
+}
+
 type Cafs struct {
 	fuse.FileSystemBase
-	metadata.Tree
+	metadata.Overlay
 	pool    string
-	remote  string
+	zpool   string
+	layout  layout.Layout
+	remotes []string
 	fetcher string
 	tracker string
 	loc     *location.Loc
+	flights flights
+	cache   *poolCache
+	client  *http.Client
+	retries int
+	// pools only read from, searched before pool
+	roPools []roPool
+	// directory of changes to the metadata, empty if read-only
+	upper string
+	dirs  dirHandles
+	// how long to wait for the tracker to know a peer
+	trackerTimeout time.Duration
+	// how long a remote may leave a request without progress
+	fetchTimeout time.Duration
+	// usage of the metadata, and whether to add the pool free space
+	size     int64
+	inodes   uint64
+	statPool bool
 }
 
 // Init is called when the file system is created.
 func (cafs *Cafs) Init() {
 }
 
-/*
+// blockSize is the block size reported by Statfs without the pool.
+const blockSize = 4096
+
 // Statfs gets file system statistics.
+// The mount is full with the files of the metadata, unless the free
+// space of the pool is added, as that is where files go when opened.
+// With an upper directory, its free space is added instead, as that is
+// where writes go.
 func (cafs *Cafs) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
-	path = filepath.Join(cafs.root, path)
-	stgo := syscall.Statfs_t{}
-	errc = errno(platform.Statfs(path, &stgo))
-	platform.CopyFusestatfsFromGostatfs(stat, &stgo)
+	*stat = fuse.Statfs_t{Bsize: blockSize, Namemax: 255}
+	dir := ""
+	if cafs.upper != "" {
+		dir = cafs.upper
+	} else if cafs.statPool {
+		dir = cafs.pool
+	}
+	if dir != "" {
+		stgo := syscall.Statfs_t{}
+		if errc = errno(platform.Statfs(dir, &stgo)); errc != 0 {
+			return
+		}
+		platform.CopyFusestatfsFromGostatfs(stat, &stgo)
+		// the free space is all there is here, whoever else uses it
+		stat.Blocks = stat.Bavail
+		stat.Bfree = stat.Bavail
+		stat.Files = stat.Ffree
+	}
+	// blocks are counted in Frsize, which CopyFusestatfsFromGostatfs
+	// leaves at 1
+	stat.Frsize = stat.Bsize
+	stat.Blocks += (uint64(cafs.size) + stat.Bsize - 1) / stat.Bsize
+	stat.Files += cafs.inodes
 	return
 }
-*/
 
 // Readlink reads the target of a symbolic link.
 func (cafs *Cafs) Readlink(path string) (errc int, target string) {
+	if cafs.upper != "" {
+		if cafs.masked(path) {
+			return -fuse.ENOENT, ""
+		}
+		upath := cafs.upperPath(path)
+		if target, err := os.Readlink(upath); err == nil {
+			return 0, target
+		} else if exists(upath) {
+			return -fuse.EINVAL, ""
+		} else if cafs.hidden(path) {
+			return -fuse.ENOENT, ""
+		}
+	}
 	target, errc = cafs.GetLink(path)
 	return
 }
 
 // Open opens a file.
 // The flags are a combination of the fuse.O_* constants.
+// Devices and FIFOs are normally opened by the kernel, any that reach
+// here fail with ENXIO, as there is no object behind them.
 func (cafs *Cafs) Open(path string, flags int) (errc int, fh uint64) {
-	return cafs.open(path, flags, 0)
-}
-
-func (cafs *Cafs) get(hash string) error {
-	tmp := filepath.Join(cafs.pool, "tmp_"+hash)
-	if err := cafs.download(hash, tmp); err != nil {
-		return err
-	}
-	object := filepath.Join(cafs.pool, hash)
-	err := os.Rename(tmp, object)
-	if cafs.loc != nil && err == nil {
-		cafs.loc.Report(hash)
-	}
-	return err
-}
-
-func (cafs *Cafs) download(hash, path string) error {
-	out, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	var url string
-	if cafs.loc == nil {
-		url = cafs.remote + hash
-	} else {
-		var t time.Duration
-		for url == "" {
-			time.Sleep(t * time.Millisecond)
-			t += 100
-			url, _ = cafs.loc.Query(hash)
+	if cafs.upper != "" {
+		if cafs.masked(path) {
+			return -fuse.ENOENT, ^uint64(0)
+		}
+		upath := cafs.upperPath(path)
+		if flags&fuse.O_ACCMODE != fuse.O_RDONLY || flags&fuse.O_TRUNC != 0 {
+			if err := cafs.copyUp(path); err != nil {
+				return errno(err), ^uint64(0)
+			}
+		}
+		if exists(upath) {
+			f, e := syscall.Open(upath, flags, 0)
+			if e != nil {
+				return errno(e), ^uint64(0)
+			}
+			return 0, uint64(f)
+		} else if cafs.hidden(path) {
+			return -fuse.ENOENT, ^uint64(0)
 		}
 	}
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	return cafs.open(path, flags, 0)
 }
 
 func (cafs *Cafs) open(path string, flags int, perm uint32) (errc int, fh uint64) {
@@ -117,30 +163,48 @@ func (cafs *Cafs) open(path string, flags int, perm uint32) (errc int, fh uint64
 		fh = ^uint64(0)
 		return
 	}
-	path = filepath.Join(cafs.pool, hash)
+	stat := syscall.Stat_t{}
+	if cafs.Stat(path, &stat) != nil {
+		return -fuse.ENOENT, ^uint64(0)
+	}
+	for _, pool := range cafs.roPools {
+		// not counted by the cache, which never evicts from here
+		f, e := syscall.Open(pool.layout.Path(pool.dir, hash), flags, perm)
+		if e == nil {
+			return 0, uint64(f)
+		} else if e != syscall.ENOENT {
+			log.Printf("[WARN] %s: %s: %v", hash, pool.dir, e)
+		}
+	}
+	cafs.cache.pin(hash)
+	path = cafs.layout.Path(cafs.pool, hash)
 	f, e := syscall.Open(path, flags, perm)
 	if e == syscall.ENOENT {
 		// get object
-		if cafs.get(hash) == nil {
+		if err := cafs.fetch(hash, stat.Size); err == nil {
 			// retry
 			f, e = syscall.Open(path, flags, perm)
+		} else {
+			log.Printf("[ERROR] %s: %v", hash, err)
+			e = syscall.EIO
 		}
 	}
 	if e != nil {
+		cafs.cache.unpin(hash)
 		return errno(e), ^uint64(0)
 	}
+	cafs.cache.opened(hash, uint64(f))
 	return 0, uint64(f)
 }
 
 // Getattr gets file attributes.
+// Attributes always come from the metadata or the upper directory,
+// even for open files, as the pool object carries the attributes of
+// whoever fetched it.
 func (cafs *Cafs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
 	stgo := syscall.Stat_t{}
-	if fh == ^uint64(0) {
-		if cafs.Stat(path, &stgo) != nil {
-			return -fuse.ENOENT
-		}
-	} else {
-		errc = errno(syscall.Fstat(int(fh), &stgo))
+	if cafs.stat(path, &stgo) != nil {
+		return -fuse.ENOENT
 	}
 	platform.CopyFusestatFromGostat(stat, &stgo)
 	return
@@ -157,40 +221,114 @@ func (cafs *Cafs) Read(path string, buff []byte, offset int64, fh uint64) (n int
 
 // Release closes an open file.
 func (cafs *Cafs) Release(path string, fh uint64) (errc int) {
+	cafs.cache.release(fh)
 	return errno(syscall.Close(int(fh)))
 }
 
-/*
+// Getxattr gets extended attributes.
+// Those of files in the upper directory are its own.
+func (cafs *Cafs) Getxattr(path string, name string) (errc int, xatr []byte) {
+	upath, errc := cafs.upperXattr(path)
+	if errc != 0 {
+		return
+	}
+	if upath != "" {
+		var err error
+		xatr, err = getxattr(upath, name)
+		return errno(err), xatr
+	}
+	xatr, errc = cafs.GetXattr(path, name)
+	return
+}
+
+// Listxattr lists extended attributes.
+func (cafs *Cafs) Listxattr(path string, fill func(name string) bool) (errc int) {
+	upath, errc := cafs.upperXattr(path)
+	if errc != 0 {
+		return
+	}
+	var names []string
+	if upath != "" {
+		var err error
+		if names, err = listxattr(upath); err != nil {
+			return errno(err)
+		}
+	} else if names, errc = cafs.ListXattr(path); errc != 0 {
+		return
+	}
+	for _, name := range names {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	return
+}
+
+// Setxattr sets extended attributes, copying the file up first.
+func (cafs *Cafs) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	upath := cafs.upperPath(path)
+	if isSymlink(upath) {
+		// as Linux does for user.* xattrs
+		return -fuse.EPERM
+	}
+	return errno(syscall.Setxattr(upath, name, value, flags))
+}
+
+// Removexattr removes extended attributes, copying the file up first.
+func (cafs *Cafs) Removexattr(path string, name string) (errc int) {
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	upath := cafs.upperPath(path)
+	if isSymlink(upath) {
+		return -fuse.ENOATTR
+	}
+	return errno(syscall.Removexattr(upath, name))
+}
+
+// Opendir opens a directory, taking a snapshot of its entries.
 func (cafs *Cafs) Opendir(path string) (errc int, fh uint64) {
-	// fmt.Println("opendir", path)
-	path = filepath.Join(cafs.root, path)
-	f, e := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
-	if e != nil {
-		return errno(e), ^uint64(0)
+	names, errc := cafs.readDir(path)
+	if errc != 0 {
+		return errc, ^uint64(0)
 	}
-	return 0, uint64(f)
+	return 0, cafs.dirs.add(names)
 }
-*/
 
 // Readdir reads a directory.
+// Entries come sorted from the snapshot of Opendir, so that offsets stay
+// valid while the directory changes, with their attributes as they are
+// read. On Linux, libfuse 2 only takes the file types from these, and
+// the kernel still looks every entry up, as readdirplus would need the
+// low-level API, so they are not worth getting ahead of Readdir.
 func (cafs *Cafs) Readdir(path string,
 	fill func(name string, stat *fuse.Stat_t, offset int64) bool,
 	offset int64,
 	fh uint64) (errc int) {
 
-	for _, name := range cafs.ListDir(path) {
-		if !fill(name, nil, 0) {
+	names := cafs.dirs.get(fh)
+	if names == nil {
+		if names, errc = cafs.readDir(path); errc != 0 {
+			return
+		}
+	}
+	for i := offset; i < int64(len(names)); i++ {
+		if !fill(names[i], cafs.direntStat(path, names[i]), i+1) {
 			break
 		}
 	}
 	return 0
 }
 
-/*
+// Releasedir closes an open directory.
 func (cafs *Cafs) Releasedir(path string, fh uint64) (errc int) {
-	return errno(syscall.Close(int(fh)))
+	cafs.dirs.remove(fh)
+	return 0
 }
-*/
+
 /*
 type config struct {
 	Pool    string `json:"pool"`
@@ -212,30 +350,133 @@ func getConfig(file string) (config, error) {
 func main() {
 	var (
 		useFetcher = flag.Bool("fetcher", false, "enable fetcher")
+		insecure   = flag.Bool("insecure", false, "mount metadata without verifying its signature")
+		upper      = flag.String("upper", "", "make the mount writable, keeping changes in `dir`,\n"+
+			"which cafs-convert -layer can turn into metadata to mount above")
 	)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %v [options] meta[:lower-meta...] mountpoint [fuse options]\n", os.Args[0])
+		fmt.Fprintf(out, "       %v serve\n", os.Args[0])
+		fmt.Fprintf(out, "       %v gc [gc options] meta|dir...\n", os.Args[0])
+		fmt.Fprintf(out, "       %v migrate [migrate options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	cfg, err := config.GetDefaultConfig()
 
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	poolLayout, err := layout.Parse(cfg.PoolLayout)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 
 	// syscall.Umask(0)
-	cafs := Cafs{pool: cfg.Pool, remote: cfg.Remote, tracker: cfg.Tracker}
+	cafs := Cafs{
+		pool:    cfg.Pool,
+		zpool:   cfg.Zpool,
+		layout:  poolLayout,
+		remotes: cfg.RemoteURLs(),
+		tracker: cfg.Tracker,
+		client:  newClient(cfg.GetFetchTimeout()),
+		retries: cfg.GetFetchRetries(),
+
+		trackerTimeout: cfg.GetTrackerTimeout(),
+		fetchTimeout:   cfg.GetFetchTimeout(),
+		statPool:       cfg.StatfsPool,
+	}
+	for i, dir := range cfg.ReadOnlyPools() {
+		l, err := layout.Parse(cfg.ReadOnlyLayout(i))
+		if err != nil {
+			log.Fatalf("Error: %s: %v", dir, err)
+		}
+		cafs.roPools = append(cafs.roPools, roPool{dir: dir, layout: l})
+	}
 	if cfg.Tracker != "" {
 		loc := location.NewLoc(cfg.Tracker)
 		if cfg.Port > 0 {
 			loc.SetPort(cfg.Port)
 		}
+		loc.SetTimeout(cfg.GetTrackerRequestTimeout())
 		cafs.loc = &loc
 		defer loc.Close()
 	}
+	if args[0] == "gc" {
+		gc(cfg, poolLayout, args[1:])
+		return
+	}
+	if args[0] == "migrate" {
+		migrate(cfg, poolLayout, args[1:])
+		return
+	}
+	if args[0] == "serve" {
+		// serve the pool to peers without mounting
+		if cfg.Port <= 0 {
+			log.Fatalf("Error: no port configured to serve on")
+		}
+		if _, err := listen(cfg.Pool, cfg.Zpool, poolLayout, cfg.Port, cafs.loc); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		select {}
+	}
 	if *useFetcher {
 		cafs.fetcher = cfg.Fetcher
 	}
-	cafs.Restore(args[0])
+	if *upper != "" {
+		if err := os.MkdirAll(*upper, 0755); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if cafs.upper, err = filepath.Abs(*upper); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if cfg.PoolCapacity > 0 {
+		if cafs.cache, err = newPoolCache(cfg.Pool, poolLayout, cfg.PoolCapacity); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	// layers are given uppermost first, separated by colons
+	layers := strings.Split(args[0], ":")
+	if *insecure {
+		err = cafs.Restore(layers...)
+	} else {
+		var keys []ed25519.PublicKey
+		for _, s := range cfg.TrustedKeys {
+			key, err := metadata.ParsePublicKey(s)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			log.Fatalf("Error: no trusted keys configured, use -insecure to mount unsigned metadata")
+		}
+		err = cafs.RestoreSigned(keys, layers...)
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer cafs.Close()
+	if cafs.size, cafs.inodes, err = cafs.Usage(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if cfg.Serve && cfg.Port > 0 {
+		// the port may be taken, such as by cafs serve or another
+		// mount, which is no reason not to mount
+		if srv, err := listen(cfg.Pool, cfg.Zpool, poolLayout, cfg.Port, cafs.loc); err != nil {
+			log.Printf("[WARN] not serving the pool: %v", err)
+		} else {
+			defer srv.Close()
+		}
+	}
 	host := fuse.NewFileSystemHost(&cafs)
 	host.Mount("", args[1:])
 }
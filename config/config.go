@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 const DefaultConfigPath = "/etc/merklefs/config.json"
@@ -14,6 +15,102 @@ type Config struct {
 	Port    int    `json:"port"`
 	Fetcher string `json:"fetcher"`
 	Tracker string `json:"tracker"`
+	// Serve makes mounts serve Pool to peers on Port, as cafs serve
+	// does. Otherwise peers are expected to be served separately.
+	Serve bool `json:"serve"`
+	// Remotes are base URLs of objects in order of preference,
+	// superseding Remote.
+	Remotes []string `json:"remotes"`
+	// TrustedKeys are hex encoded ed25519 public keys, one of which
+	// must have signed metadata to be mounted.
+	TrustedKeys []string `json:"trusted_keys"`
+	// FetchTimeout is how long a remote may take to answer a request,
+	// and then to send more of the object, in seconds. Downloads making
+	// progress are not limited in total. Zero selects the default.
+	FetchTimeout int `json:"fetch_timeout"`
+	// FetchRetries is the number of rounds over all remotes after the
+	// first, negative for none. Zero selects the default.
+	FetchRetries int `json:"fetch_retries"`
+	// TrackerTimeout is how long to wait for the tracker to know a peer
+	// holding an object, in seconds, before fetching it from Remotes.
+	TrackerTimeout int `json:"tracker_timeout"`
+	// TrackerRequestTimeout is the timeout of a single tracker request,
+	// in seconds.
+	TrackerRequestTimeout int `json:"tracker_request_timeout"`
+	// PoolCapacity limits the size of the pool in bytes, evicting the
+	// least recently used objects beyond it. Zero means no limit.
+	PoolCapacity int64 `json:"pool_capacity"`
+	// PoolLayout is the fan-out of objects in Pool and Zpool, the
+	// lengths of the hash prefixes naming each level of subdirectories
+	// separated by slashes, such as "2/2" for ab/cd/<hash>. Empty or
+	// "flat" keeps all objects directly in the pool.
+	PoolLayout string `json:"pool_layout"`
+	// Pools are pool directories in lookup order, superseding Pool.
+	// The last is the writable pool, to which objects are fetched, and
+	// Load sets Pool to it. The others, such as a shared volume seeded
+	// with objects, are only read from.
+	Pools []string `json:"pools"`
+	// ReadOnlyLayouts are the layouts of the read-only pools in Pools,
+	// in the same order, as they may be shared by hosts migrated at
+	// different times. Missing or empty entries select PoolLayout.
+	ReadOnlyLayouts []string `json:"read_only_layouts"`
+	// StatfsPool adds the free space and inodes of the filesystem of
+	// Pool to the statistics of read-only mounts, which otherwise report
+	// none. Mounts with an upper directory report those of its
+	// filesystem instead.
+	StatfsPool bool `json:"statfs_pool"`
+}
+
+const (
+	DefaultFetchTimeout   = 60 * time.Second
+	DefaultFetchRetries   = 3
+	DefaultTrackerTimeout = 5 * time.Second
+
+	DefaultTrackerRequestTimeout = time.Second
+)
+
+// RemoteURLs returns the base URLs of objects, in order of preference.
+func (cfg *Config) RemoteURLs() []string {
+	if len(cfg.Remotes) > 0 {
+		return cfg.Remotes
+	}
+	if cfg.Remote != "" {
+		return []string{cfg.Remote}
+	}
+	return nil
+}
+
+// ReadOnlyPools returns the pool directories only read from, in lookup
+// order.
+func (cfg *Config) ReadOnlyPools() []string {
+	if len(cfg.Pools) == 0 {
+		return nil
+	}
+	return cfg.Pools[:len(cfg.Pools)-1]
+}
+
+// ReadOnlyLayout returns the layout of the i-th read-only pool.
+func (cfg *Config) ReadOnlyLayout(i int) string {
+	if i < len(cfg.ReadOnlyLayouts) && cfg.ReadOnlyLayouts[i] != "" {
+		return cfg.ReadOnlyLayouts[i]
+	}
+	return cfg.PoolLayout
+}
+
+func (cfg *Config) GetFetchTimeout() time.Duration {
+	if cfg.FetchTimeout > 0 {
+		return time.Duration(cfg.FetchTimeout) * time.Second
+	}
+	return DefaultFetchTimeout
+}
+
+func (cfg *Config) GetFetchRetries() int {
+	if cfg.FetchRetries < 0 {
+		return 0
+	} else if cfg.FetchRetries > 0 {
+		return cfg.FetchRetries
+	}
+	return DefaultFetchRetries
 }
 
 func (cfg *Config) Load(file string) error {
@@ -21,7 +118,13 @@ func (cfg *Config) Load(file string) error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, cfg)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return err
+	}
+	if len(cfg.Pools) > 0 {
+		cfg.Pool = cfg.Pools[len(cfg.Pools)-1]
+	}
+	return nil
 }
 
 func GetConfig(file string) (cfg Config, err error) {
@@ -32,3 +135,17 @@ func GetConfig(file string) (cfg Config, err error) {
 func GetDefaultConfig() (cfg Config, err error) {
 	return GetConfig(DefaultConfigPath)
 }
+
+func (cfg *Config) GetTrackerTimeout() time.Duration {
+	if cfg.TrackerTimeout > 0 {
+		return time.Duration(cfg.TrackerTimeout) * time.Second
+	}
+	return DefaultTrackerTimeout
+}
+
+func (cfg *Config) GetTrackerRequestTimeout() time.Duration {
+	if cfg.TrackerRequestTimeout > 0 {
+		return time.Duration(cfg.TrackerRequestTimeout) * time.Second
+	}
+	return DefaultTrackerRequestTimeout
+}
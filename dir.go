@@ -0,0 +1,79 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/kaijchen/cafs/platform"
+)
+
+// readDir returns a snapshot of the names in directory path, sorted.
+func (cafs *Cafs) readDir(path string) (names []string, errc int) {
+	stgo := syscall.Stat_t{}
+	if cafs.stat(path, &stgo) != nil {
+		return nil, -fuse.ENOENT
+	}
+	if stgo.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, -fuse.ENOTDIR
+	}
+	names = cafs.names(path)
+	sort.Strings(names)
+	return names, 0
+}
+
+// direntStat returns the attributes of entry name in directory path
+// for Readdir, or nil if unknown.
+func (cafs *Cafs) direntStat(path, name string) *fuse.Stat_t {
+	// the parent of the root is outside, left for the kernel
+	if name == ".." && path == "/" {
+		return nil
+	}
+	stgo := syscall.Stat_t{}
+	if cafs.stat(filepath.Join(path, name), &stgo) != nil {
+		return nil
+	}
+	stat := &fuse.Stat_t{}
+	platform.CopyFusestatFromGostat(stat, &stgo)
+	return stat
+}
+
+// dirHandles are the snapshots of open directories by handle.
+type dirHandles struct {
+	mu   sync.Mutex
+	next uint64
+	m    map[uint64][]string
+}
+
+func (h *dirHandles) add(names []string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.m == nil {
+		h.m = make(map[uint64][]string)
+	}
+	h.next++
+	h.m[h.next] = names
+	return h.next
+}
+
+// get returns the snapshot of handle fh, nil if it is not open.
+func (h *dirHandles) get(fh uint64) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.m[fh]
+}
+
+func (h *dirHandles) remove(fh uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.m, fh)
+}
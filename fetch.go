@@ -0,0 +1,333 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// errCorrupt is returned for downloads not matching their hash or size.
+var errCorrupt = errors.New("corrupt object")
+
+// fetch gets object hash into the pool. Concurrent fetches of the same
+// object share a single download.
+func (cafs *Cafs) fetch(hash string, size int64) error {
+	return cafs.flights.do(hash, func() error {
+		if _, err := os.Stat(cafs.layout.Path(cafs.pool, hash)); err == nil {
+			// fetched by a flight that just landed
+			return nil
+		}
+		return cafs.get(hash, size)
+	})
+}
+
+func (cafs *Cafs) get(hash string, size int64) error {
+	// a unique name, so that leftovers of crashed downloads do no harm
+	tmp, err := os.CreateTemp(cafs.pool, "tmp_"+hash+"_")
+	if err != nil {
+		return err
+	}
+	if err = cafs.decompressLocal(hash, size, tmp); err != nil {
+		err = cafs.download(hash, size, tmp)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// CreateTemp makes files private, objects are not
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := cafs.layout.Create(cafs.pool, hash); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cafs.layout.Path(cafs.pool, hash)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	cafs.cache.add(hash, size)
+	if cafs.loc != nil {
+		cafs.loc.Report(hash)
+	}
+	return nil
+}
+
+// download fetches object hash to out, verifying its content. A peer
+// known to the tracker is tried first, then each remote in turn, for up
+// to cafs.retries more rounds with exponential backoff in between.
+func (cafs *Cafs) download(hash string, size int64, out *os.File) error {
+	var urls []string
+	var peer string
+	if cafs.loc != nil {
+		if peer = cafs.queryPeer(hash); peer != "" {
+			urls = append(urls, peer)
+		}
+	}
+	for _, remote := range cafs.remotes {
+		urls = append(urls, remote+hash)
+	}
+	if len(urls) == 0 {
+		return errors.New("no remote configured")
+	}
+
+	var err error
+	failed := make(map[string]bool) // URLs not worth retrying
+	backoff := minBackoff
+	for round := 0; round <= cafs.retries; round++ {
+		if round > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		for _, url := range urls {
+			if failed[url] {
+				continue
+			}
+			err = cafs.downloadFrom(url, hash, size, out)
+			if err == nil {
+				return nil
+			}
+			log.Printf("[WARN] %s: %v", hash, err)
+			if url == peer {
+				// the tracker has no way to hear of bad peers, but
+				// Report still releases the load the query put on it
+				log.Printf("[WARN] %s: bad peer %s, falling back to the remotes", hash, peer)
+				failed[url] = true
+			} else if _, ok := err.(permanentError); ok {
+				failed[url] = true
+			}
+		}
+		if len(failed) == len(urls) {
+			break
+		}
+	}
+	return fmt.Errorf("download failed: %w", err)
+}
+
+// queryPeer asks the tracker for a peer holding object hash, until one
+// is known or cafs.trackerTimeout passed, returning "" in the latter case.
+func (cafs *Cafs) queryPeer(hash string) string {
+	deadline := time.Now().Add(cafs.trackerTimeout)
+	var t time.Duration
+	for {
+		if url, _ := cafs.loc.Query(hash); url != "" {
+			return url
+		}
+		t += 100 * time.Millisecond
+		if time.Now().Add(t).After(deadline) {
+			return ""
+		}
+		time.Sleep(t)
+	}
+}
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// permanentError is a failure that retrying the same URL will not fix.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// zstSuffix is appended to the names of zstd compressed objects.
+const zstSuffix = ".zst"
+
+var errNotFound = errors.New("not found")
+
+// decompressLocal gets object hash to out from the local zpool.
+func (cafs *Cafs) decompressLocal(hash string, size int64, out *os.File) error {
+	if cafs.zpool == "" {
+		return errNotFound
+	}
+	f, err := os.Open(cafs.layout.Path(cafs.zpool, hash+zstSuffix))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := reset(out); err != nil {
+		return err
+	}
+	if err := copyVerified(out, f, true, hash, size); err != nil {
+		log.Printf("[WARN] %s: %s: %v", hash, f.Name(), err)
+		return err
+	}
+	return nil
+}
+
+// downloadFrom fetches object hash from url to out, preferring its
+// compressed form at url+zstSuffix.
+func (cafs *Cafs) downloadFrom(url, hash string, size int64, out *os.File) error {
+	err := cafs.downloadURL(url+zstSuffix, true, hash, size, out)
+	if errors.Is(err, errNotFound) {
+		err = cafs.downloadURL(url, false, hash, size, out)
+	}
+	return err
+}
+
+// downloadURL fetches object hash from url to out, replacing its content.
+func (cafs *Cafs) downloadURL(url string, compressed bool, hash string, size int64, out *os.File) error {
+	if err := reset(out); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cafs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return permanentError{fmt.Errorf("%s: %w", url, errNotFound)}
+	} else if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s", url, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	var body io.Reader = resp.Body
+	if cafs.fetchTimeout > 0 {
+		r := &idleReader{r: body, timeout: cafs.fetchTimeout}
+		r.timer = time.AfterFunc(cafs.fetchTimeout, cancel)
+		defer r.timer.Stop()
+		body = r
+	}
+	if err := copyVerified(out, body, compressed, hash, size); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: stalled for %v", url, cafs.fetchTimeout)
+		}
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return nil
+}
+
+// reset empties out for a new attempt.
+func reset(out *os.File) error {
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return out.Truncate(0)
+}
+
+// copyVerified copies object hash of size from r to out, decompressing
+// it if compressed, and fails with errCorrupt if it does not match.
+func copyVerified(out io.Writer, r io.Reader, compressed bool, hash string, size int64) error {
+	if compressed {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		r = dec
+	}
+	h := sha256.New()
+	// read one byte past size to detect overlong objects
+	n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(r, size+1))
+	if err != nil {
+		return err
+	}
+	if n != size || hex.EncodeToString(h.Sum(nil)) != hash {
+		return errCorrupt
+	}
+	return nil
+}
+
+// newClient returns an HTTP client giving up on remotes not answering
+// within timeout. Unlike http.Client.Timeout, it does not limit reading
+// the body, which downloadURL bounds between reads instead, so large
+// objects can still be downloaded over slow links.
+func newClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: t}
+}
+
+// idleReader pushes back its timer by timeout on every Read making
+// progress, so the timer fires once r stalls for timeout.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// flights deduplicates concurrent calls by key.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do calls fn, unless a call for key is in flight, in which case
+// it waits for that call and returns its result.
+func (g *flights) do(key string, fn func() error) error {
+	g.mu.Lock()
+	if f, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	if g.m == nil {
+		g.m = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.m[key] = f
+	g.mu.Unlock()
+
+	f.err = fn()
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.err
+}
@@ -0,0 +1,356 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaijchen/cafs/layout"
+	"github.com/kaijchen/cafs/location"
+	"github.com/kaijchen/cafs/metadata"
+	pb "github.com/kaijchen/tracker/track"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc"
+)
+
+var testObject = []byte("hello, world\n")
+
+func testHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestCafs(t *testing.T, remotes ...string) *Cafs {
+	return &Cafs{
+		pool:    t.TempDir(),
+		remotes: remotes,
+		client:  newClient(5 * time.Second),
+
+		fetchTimeout: 5 * time.Second,
+	}
+}
+
+// objectHandler serves data for /<hash>, and 404 for anything else,
+// counting the requests for each path.
+type objectHandler struct {
+	data  []byte
+	mu    sync.Mutex
+	count map[string]int
+	// status, if not zero, is returned instead for the first fails requests
+	status int
+	fails  int
+}
+
+func (h *objectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if h.count == nil {
+		h.count = make(map[string]int)
+	}
+	h.count[r.URL.Path]++
+	n := h.count[r.URL.Path]
+	h.mu.Unlock()
+	if r.URL.Path != "/"+testHash(testObject) {
+		http.NotFound(w, r)
+		return
+	}
+	if h.status != 0 && n <= h.fails {
+		w.WriteHeader(h.status)
+		return
+	}
+	w.Write(h.data)
+}
+
+func (h *objectHandler) requests(path string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count[path]
+}
+
+func TestCopyVerified(t *testing.T) {
+	hash, size := testHash(testObject), int64(len(testObject))
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"complete", testObject, nil},
+		{"truncated", testObject[:size-1], errCorrupt},
+		{"overlong", append(append([]byte{}, testObject...), 'x'), errCorrupt},
+		{"different", bytes.ToUpper(testObject), errCorrupt},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := copyVerified(&out, bytes.NewReader(tt.data), false, hash, size)
+		if err != tt.want {
+			t.Errorf("%s: copyVerified = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	var z bytes.Buffer
+	enc, _ := zstd.NewWriter(&z)
+	enc.Write(testObject)
+	enc.Close()
+	var out bytes.Buffer
+	if err := copyVerified(&out, &z, true, hash, size); err != nil || !bytes.Equal(out.Bytes(), testObject) {
+		t.Errorf("copyVerified of compressed object = %v, %q", err, out.Bytes())
+	}
+}
+
+func TestFetchSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	h := &objectHandler{data: testObject}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, zstSuffix) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cafs := newTestCafs(t, srv.URL+"/")
+
+	hash := testHash(testObject)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cafs.fetch(hash, int64(len(testObject)))
+		}(i)
+	}
+	<-started
+	// let the others join the flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("fetch %d: %v", i, err)
+		}
+	}
+	if n := h.requests("/" + hash); n != 1 {
+		t.Errorf("object downloaded %d times, want 1", n)
+	}
+	if data, err := os.ReadFile(cafs.layout.Path(cafs.pool, hash)); err != nil || !bytes.Equal(data, testObject) {
+		t.Errorf("pool object = %q, %v", data, err)
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	hash, size := testHash(testObject), int64(len(testObject))
+	tests := []struct {
+		name     string
+		status   int
+		fails    int
+		ok       bool
+		requests int
+	}{
+		// not found is not worth retrying
+		{"not found", http.StatusNotFound, 10, false, 1},
+		{"unavailable", http.StatusServiceUnavailable, 2, true, 3},
+		{"always unavailable", http.StatusServiceUnavailable, 10, false, 3},
+	}
+	for _, tt := range tests {
+		h := &objectHandler{data: testObject, status: tt.status, fails: tt.fails}
+		srv := httptest.NewServer(h)
+		cafs := newTestCafs(t, srv.URL+"/")
+		cafs.retries = 2
+
+		out, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cafs.download(hash, size, out)
+		out.Close()
+		srv.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: download = %v", tt.name, err)
+		}
+		if n := h.requests("/" + hash); n != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, n, tt.requests)
+		}
+	}
+}
+
+func TestDownloadSlowBody(t *testing.T) {
+	hash, size := testHash(testObject), int64(len(testObject))
+	tests := []struct {
+		name string
+		gap  time.Duration
+		ok   bool
+	}{
+		// longer in total than the timeout, but never idle for as long
+		{"slow", 50 * time.Millisecond, true},
+		{"stalled", time.Second, false},
+	}
+	for _, tt := range tests {
+		gap := tt.gap
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := range testObject {
+				if i > 0 {
+					select {
+					case <-time.After(gap):
+					case <-r.Context().Done():
+						return
+					}
+				}
+				w.Write(testObject[i : i+1])
+				w.(http.Flusher).Flush()
+			}
+		}))
+		cafs := newTestCafs(t)
+		cafs.client = newClient(200 * time.Millisecond)
+		cafs.fetchTimeout = 200 * time.Millisecond
+
+		out, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cafs.downloadURL(srv.URL+"/"+hash, false, hash, size, out)
+		out.Close()
+		srv.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: downloadURL = %v", tt.name, err)
+		}
+	}
+}
+
+// peerTracker hands out a single peer for every key, recording the
+// sources reported.
+type peerTracker struct {
+	pb.UnimplementedTrackerServer
+	peer   string
+	source int64
+	mu     sync.Mutex
+	report []int64
+}
+
+func (s *peerTracker) Query(ctx context.Context, r *pb.QueryRequest) (*pb.QueryReply, error) {
+	return &pb.QueryReply{Location: s.peer, Source: s.source}, nil
+}
+
+func (s *peerTracker) Report(ctx context.Context, r *pb.ReportRequest) (*pb.ReportReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = append(s.report, r.GetSource())
+	return &pb.ReportReply{Ok: true}, nil
+}
+
+func TestFetchPeerFallback(t *testing.T) {
+	// the peer serves a corrupt object, the remote a good one
+	peer := &objectHandler{data: bytes.ToUpper(testObject)}
+	peerSrv := httptest.NewServer(peer)
+	defer peerSrv.Close()
+	remote := &objectHandler{data: testObject}
+	remoteSrv := httptest.NewServer(remote)
+	defer remoteSrv.Close()
+
+	u, _ := url.Parse(peerSrv.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	tracker := &peerTracker{peer: host, source: 7}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcSrv := grpc.NewServer()
+	pb.RegisterTrackerServer(grpcSrv, tracker)
+	go grpcSrv.Serve(lis)
+	defer grpcSrv.Stop()
+
+	loc := location.NewLoc(lis.Addr().String())
+	defer loc.Close()
+	p, _ := strconv.Atoi(port)
+	loc.SetPort(p)
+	loc.SetTimeout(5 * time.Second)
+
+	cafs := newTestCafs(t, remoteSrv.URL+"/")
+	cafs.loc = &loc
+	cafs.trackerTimeout = time.Second
+	hash := testHash(testObject)
+	if err := cafs.fetch(hash, int64(len(testObject))); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if peer.requests("/"+hash) != 1 || remote.requests("/"+hash) != 1 {
+		t.Errorf("requests: peer %d, remote %d, want 1 each",
+			peer.requests("/"+hash), remote.requests("/"+hash))
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	// the load of the peer is released even though it failed
+	if len(tracker.report) != 1 || tracker.report[0] != 7 {
+		t.Errorf("reported sources %v, want [7]", tracker.report)
+	}
+}
+
+func TestOpenReadOnlyPool(t *testing.T) {
+	root, ro := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), testObject, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := testHash(testObject)
+	tree := &metadata.Tree{}
+	if err := tree.Build(root, func(path string) string { return hash }); err != nil {
+		t.Fatal(err)
+	}
+	// the shared pool is still flat while the writable one is sharded
+	if err := os.WriteFile(filepath.Join(ro, hash), testObject, 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote := &objectHandler{data: testObject}
+	srv := httptest.NewServer(remote)
+	defer srv.Close()
+	cafs := newTestCafs(t, srv.URL+"/")
+	cafs.layout = layout.Layout{2, 2}
+	cafs.roPools = []roPool{{dir: ro, layout: layout.Flat}}
+	cafs.Overlay = *metadata.NewOverlay(tree)
+
+	errc, fh := cafs.Open("/file", os.O_RDONLY)
+	if errc != 0 {
+		t.Fatalf("Open = %d", errc)
+	}
+	buf := make([]byte, 64)
+	n := cafs.Read("/file", buf, 0, fh)
+	cafs.Release("/file", fh)
+	if n < 0 || !bytes.Equal(buf[:n], testObject) {
+		t.Errorf("Read = %d, want %q", n, testObject)
+	}
+	if n := remote.requests("/" + hash); n != 0 {
+		t.Errorf("object fetched %d times, want none", n)
+	}
+	if entries, _ := os.ReadDir(cafs.pool); len(entries) != 0 {
+		t.Errorf("writable pool has %d entries, want none", len(entries))
+	}
+}
+
+func TestFlightsError(t *testing.T) {
+	var g flights
+	want := errors.New("failed")
+	if err := g.do("key", func() error { return want }); err != want {
+		t.Errorf("do = %v, want %v", err, want)
+	}
+	// a finished flight is not shared
+	if err := g.do("key", func() error { return nil }); err != nil {
+		t.Errorf("do after failure = %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kaijchen/cafs/config"
+	"github.com/kaijchen/cafs/layout"
+	"github.com/kaijchen/cafs/metadata"
+)
+
+// gc removes the objects in the pool and zpool not referred to by any
+// of the metadata files given, as well as stale temporary files.
+// Read-only pools are left alone.
+func gc(cfg config.Config, l layout.Layout, args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	var (
+		dryRun = flags.Bool("n", false, "only report what would be removed")
+		tmpAge = flags.Duration("tmp-age", time.Hour, "remove temporary files older than this")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v gc [options] meta|dir...\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Removes objects not referred to by the metadata files, or those in the directories.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	live := make(map[string]bool)
+	for _, arg := range flags.Args() {
+		files, err := metadataFiles(arg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		for _, file := range files {
+			// failing to mark a tree would lose its objects, so bail out
+			if err := mark(file, live); err != nil {
+				log.Fatalf("Error: %s: %v", file, err)
+			}
+		}
+	}
+	log.Printf("[INFO] %d live objects", len(live))
+
+	s := sweeper{layout: l, live: live, dryRun: *dryRun, tmpBefore: time.Now().Add(-*tmpAge)}
+	if cfg.Pool != "" {
+		s.sweep(cfg.Pool, "")
+	}
+	if cfg.Zpool != "" {
+		s.sweep(cfg.Zpool, zstSuffix)
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	log.Printf("[INFO] %s %d files, %d bytes", verb, s.files, s.bytes)
+}
+
+// metadataFiles returns path if it is a file, or the metadata files
+// directly in it if it is a directory.
+func metadataFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), metadata.SignatureSuffix) {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// mark adds the objects referred to by the metadata file to live.
+func mark(file string, live map[string]bool) error {
+	var t metadata.Tree
+	if err := t.Restore(file); err != nil {
+		return err
+	}
+	defer t.Close()
+	return t.WalkObjects(func(hash string) {
+		live[hash] = true
+	})
+}
+
+type sweeper struct {
+	layout    layout.Layout
+	live      map[string]bool
+	dryRun    bool
+	tmpBefore time.Time
+	files     int
+	bytes     int64
+}
+
+// sweep removes files named <hash><suffix> in dir that are not live,
+// and temporary files older than s.tmpBefore.
+func (s *sweeper) sweep(dir, suffix string) {
+	// temporary files are only ever made in the top directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "tmp_") {
+			continue
+		}
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() && info.ModTime().Before(s.tmpBefore) {
+			s.remove(filepath.Join(dir, e.Name()), info.Size())
+		}
+	}
+	err = s.layout.Walk(dir, func(path string, d fs.DirEntry) error {
+		hash := strings.TrimSuffix(d.Name(), suffix)
+		if !validHash(hash) || d.Name() != hash+suffix || s.live[hash] {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			s.remove(path, info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
+
+// remove removes the file at path of size, or prints its path if
+// this is a dry run.
+func (s *sweeper) remove(path string, size int64) {
+	if s.dryRun {
+		fmt.Println(path)
+	} else if err := os.Remove(path); err != nil {
+		log.Printf("[ERROR] %v", err)
+		return
+	}
+	s.files++
+	s.bytes += size
+}
@@ -0,0 +1,93 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kaijchen/cafs/layout"
+	"github.com/kaijchen/cafs/metadata"
+)
+
+func TestSweep(t *testing.T) {
+	live, dead := testHash([]byte("live")), testHash([]byte("dead"))
+	now := time.Now()
+	for _, lay := range []string{"flat", "2/2"} {
+		for _, dryRun := range []bool{false, true} {
+			l, err := layout.Parse(lay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool, zpool := t.TempDir(), t.TempDir()
+			putObject(t, l, pool, live, []byte("live"))
+			putObject(t, l, pool, dead, []byte("dead"))
+			putObject(t, l, zpool, live+zstSuffix, []byte("live"))
+			putObject(t, l, zpool, dead+zstSuffix, []byte("dead"))
+			// temporary files are made in the top directory
+			oldTmp, newTmp := filepath.Join(pool, "tmp_old"), filepath.Join(pool, "tmp_new")
+			for _, path := range []string{oldTmp, newTmp} {
+				if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := now.Add(-2 * time.Hour)
+			if err := os.Chtimes(oldTmp, old, old); err != nil {
+				t.Fatal(err)
+			}
+			other := filepath.Join(pool, "notes")
+			if err := os.WriteFile(other, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := sweeper{layout: l, live: map[string]bool{live: true}, dryRun: dryRun, tmpBefore: now.Add(-time.Hour)}
+			s.sweep(pool, "")
+			s.sweep(zpool, zstSuffix)
+
+			kept := []string{l.Path(pool, live), l.Path(zpool, live+zstSuffix), newTmp, other}
+			removed := []string{l.Path(pool, dead), l.Path(zpool, dead+zstSuffix), oldTmp}
+			for _, path := range kept {
+				if !exists(path) {
+					t.Errorf("%s, dry run %v: %s removed", lay, dryRun, path)
+				}
+			}
+			for _, path := range removed {
+				if exists(path) != dryRun {
+					t.Errorf("%s, dry run %v: %s kept: %v", lay, dryRun, path, exists(path))
+				}
+			}
+			if s.files != 3 || s.bytes != 4+4+7 {
+				t.Errorf("%s, dry run %v: %d files, %d bytes, want 3, 15", lay, dryRun, s.files, s.bytes)
+			}
+		}
+	}
+}
+
+func TestMetadataFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "a" + metadata.SignatureSuffix} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	if files, err := metadataFiles(dir); err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("metadataFiles(dir) = %v, %v, want %v", files, err, want)
+	}
+	// a file given is taken as is
+	file := filepath.Join(dir, "a")
+	if files, err := metadataFiles(file); err != nil || !reflect.DeepEqual(files, []string{file}) {
+		t.Errorf("metadataFiles(file) = %v, %v", files, err)
+	}
+	if _, err := metadataFiles(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("metadataFiles of a missing path succeeded")
+	}
+}
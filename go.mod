@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/billziss-gh/cgofuse v1.5.0
 	github.com/kaijchen/tracker v0.0.0-20211123093320-55dcdd585294
+	github.com/klauspost/compress v1.15.9
 	google.golang.org/grpc v1.42.0
 )
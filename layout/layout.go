@@ -0,0 +1,117 @@
+package layout
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Layout is the fan-out of a pool directory, the length of the name
+// prefix naming the subdirectory at each level. Layout{2, 2} puts
+// object <hash> at ab/cd/<hash>, where ab and cd start the hash.
+// An empty Layout keeps every object directly in the pool.
+type Layout []int
+
+// Flat is the layout of a pool without subdirectories.
+var Flat Layout
+
+// maxPrefix bounds the total prefix length, well below a hash.
+const maxPrefix = 16
+
+// Parse returns the Layout described by s, the prefix lengths separated
+// by slashes, such as "2/2". An empty s or "flat" is Flat.
+func Parse(s string) (Layout, error) {
+	if s == "" || s == "flat" {
+		return Flat, nil
+	}
+	var l Layout
+	total := 0
+	for _, f := range strings.Split(s, "/") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid pool layout %q", s)
+		}
+		total += n
+		l = append(l, n)
+	}
+	if total > maxPrefix {
+		return nil, fmt.Errorf("pool layout %q too deep", s)
+	}
+	return l, nil
+}
+
+func (l Layout) String() string {
+	if len(l) == 0 {
+		return "flat"
+	}
+	s := make([]string, len(l))
+	for i, n := range l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, "/")
+}
+
+// Dir returns the directory of name relative to the pool.
+func (l Layout) Dir(name string) string {
+	parts := make([]string, 0, len(l))
+	off := 0
+	for _, n := range l {
+		if off+n > len(name) {
+			break
+		}
+		parts = append(parts, name[off:off+n])
+		off += n
+	}
+	return filepath.Join(parts...)
+}
+
+// Path returns the path of name, an object or a derived file such as
+// its compressed form, in pool dir.
+func (l Layout) Path(dir, name string) string {
+	return filepath.Join(dir, l.Dir(name), name)
+}
+
+// Create makes the directory of name in pool dir, so that name can be
+// put at l.Path(dir, name).
+func (l Layout) Create(dir, name string) error {
+	if len(l) == 0 {
+		return nil
+	}
+	return os.MkdirAll(filepath.Join(dir, l.Dir(name)), 0755)
+}
+
+// Walk calls fn for each regular file at the object level of pool dir,
+// with its path. Names not fitting the layout are skipped, as are the
+// subdirectories they would be found in.
+func (l Layout) Walk(dir string, fn func(path string, d fs.DirEntry) error) error {
+	return l.walk(dir, "", 0, fn)
+}
+
+func (l Layout) walk(dir, prefix string, level int, fn func(path string, d fs.DirEntry) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if level == len(l) {
+			if e.Type().IsRegular() && strings.HasPrefix(name, prefix) {
+				if err := fn(filepath.Join(dir, name), e); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !e.IsDir() || len(name) != l[level] {
+			continue
+		}
+		err := l.walk(filepath.Join(dir, name), prefix+name, level+1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
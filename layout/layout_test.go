@@ -0,0 +1,86 @@
+package layout
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"flat", "2", "2/2", "1/2/3"} {
+		l, err := Parse(s)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", s, err)
+		} else if l.String() != s {
+			t.Errorf("Parse(%q).String() = %q", s, l.String())
+		}
+	}
+	if l, err := Parse(""); err != nil || len(l) != 0 {
+		t.Errorf("Parse(\"\") = %v, %v, want Flat", l, err)
+	}
+	for _, s := range []string{"x", "2/", "0", "-1/2", "8/8/8"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	hash := "abcdef"
+	tests := []struct {
+		layout Layout
+		name   string
+		want   string
+	}{
+		{Flat, hash, "pool/abcdef"},
+		{Layout{2}, hash, "pool/ab/abcdef"},
+		{Layout{2, 2}, hash, "pool/ab/cd/abcdef"},
+		{Layout{2, 2}, hash + ".zst", "pool/ab/cd/abcdef.zst"},
+	}
+	for _, tt := range tests {
+		if got := tt.layout.Path("pool", tt.name); got != tt.want {
+			t.Errorf("%v.Path(%q) = %q, want %q", tt.layout, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir := t.TempDir()
+	l := Layout{2, 2}
+	names := []string{"abcdef", "abcd12", "ab9999"}
+	for _, name := range names {
+		if err := l.Create(dir, name); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(l.Path(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not fitting the layout
+	if err := os.WriteFile(filepath.Join(dir, "tmp_abcdef_1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ab", "cd", "xyz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "abc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := l.Walk(dir, func(path string, d fs.DirEntry) error {
+		got = append(got, d.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(names)
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("Walk visited %q, want %q", got, names)
+	}
+}
@@ -5,17 +5,29 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	pb "github.com/kaijchen/tracker/track"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// DefaultTimeout is the default timeout of a tracker request.
+const DefaultTimeout = time.Second
+
+// batchSize is the number of concurrent requests of batch calls.
+const batchSize = 16
+
+// Loc locates objects through a tracker. It is safe for concurrent use.
 type Loc struct {
 	client   pb.TrackerClient
 	conn     *grpc.ClientConn
 	hostname string
 	port     string
+	timeout  time.Duration
+	mu       *sync.Mutex
 	source   map[string]int64
 }
 
@@ -29,7 +41,8 @@ func NewLoc(addr string) Loc {
 	if err != nil {
 		log.Fatalf("failed to get hostname: %v", err)
 	}
-	return Loc{client: c, conn: conn, hostname: hn, source: make(map[string]int64)}
+	return Loc{client: c, conn: conn, hostname: hn, timeout: DefaultTimeout,
+		mu: new(sync.Mutex), source: make(map[string]int64)}
 }
 
 func (loc *Loc) Close() {
@@ -40,24 +53,110 @@ func (loc *Loc) SetPort(p int) {
 	loc.port = ":" + strconv.Itoa(p)
 }
 
-func (loc *Loc) Query(key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// SetTimeout sets the timeout of each tracker request.
+func (loc *Loc) SetTimeout(d time.Duration) {
+	loc.timeout = d
+}
+
+// call runs rpc with the request timeout. If the tracker is unavailable,
+// it retries once, waiting for the connection to be reestablished.
+func (loc *Loc) call(rpc func(ctx context.Context, opts ...grpc.CallOption) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), loc.timeout)
+	err := rpc(ctx)
+	cancel()
+	if status.Code(err) != codes.Unavailable {
+		return err
+	}
+	loc.conn.ResetConnectBackoff()
+	ctx, cancel = context.WithTimeout(context.Background(), loc.timeout)
 	defer cancel()
-	r, err := loc.client.Query(ctx, &pb.QueryRequest{Key: key})
+	return rpc(ctx, grpc.WaitForReady(true))
+}
+
+func (loc *Loc) Query(key string) (string, error) {
+	var r *pb.QueryReply
+	err := loc.call(func(ctx context.Context, opts ...grpc.CallOption) (err error) {
+		r, err = loc.client.Query(ctx, &pb.QueryRequest{Key: key}, opts...)
+		return
+	})
 	if err != nil || r.GetLocation() == "" {
 		return "", err
 	}
 	url := "http://" + r.GetLocation() + loc.port + "/" + key
+	loc.mu.Lock()
 	loc.source[key] = r.GetSource()
+	loc.mu.Unlock()
 	return url, nil
 }
 
 func (loc *Loc) Report(key string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	_, err := loc.client.Report(ctx, &pb.ReportRequest{Key: key, Location: loc.hostname, Source: loc.source[key]})
+	loc.mu.Lock()
+	source, ok := loc.source[key]
+	loc.mu.Unlock()
+	if !ok {
+		// not fetched from a peer, so no peer load to release
+		source = -1
+	}
+	err := loc.call(func(ctx context.Context, opts ...grpc.CallOption) error {
+		_, err := loc.client.Report(ctx, &pb.ReportRequest{Key: key, Location: loc.hostname, Source: source}, opts...)
+		return err
+	})
 	if err == nil {
+		loc.mu.Lock()
 		delete(loc.source, key)
+		loc.mu.Unlock()
 	}
 	return err
 }
+
+// QueryBatch queries many keys at once, returning the URLs of those
+// found, and the first error encountered.
+func (loc *Loc) QueryBatch(keys []string) (map[string]string, error) {
+	var mu sync.Mutex
+	urls := make(map[string]string)
+	err := batch(keys, func(key string) error {
+		url, err := loc.Query(key)
+		if url != "" {
+			mu.Lock()
+			urls[key] = url
+			mu.Unlock()
+		}
+		return err
+	})
+	return urls, err
+}
+
+// ReportBatch reports many keys at once, returning the first error
+// encountered.
+func (loc *Loc) ReportBatch(keys []string) error {
+	return batch(keys, loc.Report)
+}
+
+// batch calls fn for each key, batchSize at a time.
+func batch(keys []string, fn func(key string) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, batchSize)
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(key); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+	return firstErr
+}
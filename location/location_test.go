@@ -1,8 +1,16 @@
 package location
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"os"
+	"sync"
 	"testing"
+	"time"
+
+	pb "github.com/kaijchen/tracker/track"
+	"google.golang.org/grpc"
 )
 
 func TestLocation(t *testing.T) {
@@ -32,3 +40,58 @@ func TestLocation(t *testing.T) {
 		t.Errorf("Object not found")
 	}
 }
+
+// fakeTracker remembers the last location reported for each key.
+type fakeTracker struct {
+	pb.UnimplementedTrackerServer
+	mu   sync.Mutex
+	locs map[string]string
+}
+
+func (s *fakeTracker) Report(ctx context.Context, r *pb.ReportRequest) (*pb.ReportReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locs[r.GetKey()] = r.GetLocation()
+	return &pb.ReportReply{Ok: true}, nil
+}
+
+func (s *fakeTracker) Query(ctx context.Context, r *pb.QueryRequest) (*pb.QueryReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &pb.QueryReply{Location: s.locs[r.GetKey()]}, nil
+}
+
+func TestBatch(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterTrackerServer(srv, &fakeTracker{locs: make(map[string]string)})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	loc := NewLoc(lis.Addr().String())
+	defer loc.Close()
+	loc.SetTimeout(5 * time.Second)
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	if err := loc.ReportBatch(keys[:50]); err != nil {
+		t.Fatalf("ReportBatch error: %v", err)
+	}
+	urls, err := loc.QueryBatch(keys)
+	if err != nil {
+		t.Fatalf("QueryBatch error: %v", err)
+	}
+	if len(urls) != 50 {
+		t.Errorf("QueryBatch found %d keys, want 50", len(urls))
+	}
+	for _, key := range keys[:50] {
+		if urls[key] != "http://"+loc.hostname+"/"+key {
+			t.Errorf("QueryBatch[%q] = %q", key, urls[key])
+		}
+	}
+}
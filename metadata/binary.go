@@ -0,0 +1,314 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Binary metadata layout (all integers little endian):
+//
+//	header  magic[8] version:u32 reserved:u32 count:u64
+//	index   count * offset:u64, offset of each node record, ordered by ino
+//	records one per node
+//
+// A node record is
+//
+//	mode:u32 nlink:u32 flags:u32 uid:u32 gid:u32 size:i64 rdev:u64
+//	atime:i64 mtime:i64 ctime:i64 sino:u64
+//	vlen:u32 value[vlen]
+//	nxattrs:u32 nxattrs * (nlen:u16 name[nlen] vlen:u32 value[vlen]), sorted by name
+//	ndirents:u32
+//	ndirents * doff:u32, offset of each dirent relative to the first dirent
+//	ndirents * (ino:u64 nlen:u16 name[nlen]), sorted by name
+//
+// so a directory entry can be found by binary search without decoding
+// the whole directory. Times are in nanoseconds since the epoch.
+const (
+	magic      = "CAFSTREE"
+	version    = 1
+	headerSize = 24
+)
+
+// Node flags in binary metadata.
+const (
+	flagWhiteout = 1 << iota
+	flagOpaque
+)
+
+var order = binary.LittleEndian
+
+var errCorrupt = errors.New("corrupt metadata")
+
+// Format is an on-disk metadata format.
+type Format int
+
+const (
+	FormatBinary Format = iota
+	FormatJSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatBinary:
+		return "binary"
+	case FormatJSON:
+		return "json"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the Format named by s.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "binary", "bin":
+		return FormatBinary, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown metadata format %q", s)
+}
+
+// Encode returns the tree in binary metadata format.
+func (t *Tree) Encode() ([]byte, error) {
+	count := t.count()
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	put32(&buf, version)
+	put32(&buf, 0)
+	put64(&buf, uint64(count))
+	index := buf.Len()
+	buf.Write(make([]byte, 8*count))
+	for ino := uint64(1); ino <= uint64(count); ino++ {
+		n := t.node(ino)
+		if n == nil {
+			return nil, errCorrupt
+		}
+		order.PutUint64(buf.Bytes()[index+8*int(ino-1):], uint64(buf.Len()))
+		if err := encodeNode(&buf, n, t.dirents(ino)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeNode(buf *bytes.Buffer, n *Node, dirents map[string]uint64) error {
+	put32(buf, n.Mode)
+	put32(buf, n.Nlink)
+	var flags uint32
+	if n.Whiteout {
+		flags |= flagWhiteout
+	}
+	if n.Opaque {
+		flags |= flagOpaque
+	}
+	put32(buf, flags)
+	put32(buf, n.Uid)
+	put32(buf, n.Gid)
+	put64(buf, uint64(n.Size))
+	put64(buf, n.Rdev)
+	put64(buf, uint64(n.Atime))
+	put64(buf, uint64(n.Mtime))
+	put64(buf, uint64(n.Ctime))
+	put64(buf, n.Sino)
+	put32(buf, uint32(len(n.Value)))
+	buf.WriteString(n.Value)
+
+	xnames := make([]string, 0, len(n.Xattrs))
+	for name := range n.Xattrs {
+		if len(name) > 0xffff {
+			return fmt.Errorf("xattr name too long: %q", name)
+		}
+		xnames = append(xnames, name)
+	}
+	sort.Strings(xnames)
+	put32(buf, uint32(len(xnames)))
+	for _, name := range xnames {
+		put16(buf, uint16(len(name)))
+		buf.WriteString(name)
+		put32(buf, uint32(len(n.Xattrs[name])))
+		buf.Write(n.Xattrs[name])
+	}
+
+	names := make([]string, 0, len(dirents))
+	for name := range dirents {
+		if len(name) > 0xffff {
+			return fmt.Errorf("name too long: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	put32(buf, uint32(len(names)))
+	var off uint32
+	for _, name := range names {
+		put32(buf, off)
+		off += 10 + uint32(len(name))
+	}
+	for _, name := range names {
+		put64(buf, dirents[name])
+		put16(buf, uint16(len(name)))
+		buf.WriteString(name)
+	}
+	return nil
+}
+
+func put16(buf *bytes.Buffer, v uint16) {
+	var b [2]byte
+	order.PutUint16(b[:], v)
+	buf.Write(b[:])
+}
+
+func put32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	order.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func put64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	order.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+// checkHeader validates the header and index of binary metadata.
+func checkHeader(data []byte) error {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return errors.New("not binary metadata")
+	}
+	if v := order.Uint32(data[8:]); v != version {
+		return fmt.Errorf("unsupported metadata version %d", v)
+	}
+	count := order.Uint64(data[16:])
+	if count == 0 || count > uint64(len(data)-headerSize)/8 {
+		return errCorrupt
+	}
+	for i := uint64(0); i < count; i++ {
+		if off := order.Uint64(data[headerSize+8*i:]); off >= uint64(len(data)) {
+			return errCorrupt
+		}
+	}
+	return nil
+}
+
+// record is a view of a single node record in binary metadata.
+type record struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+func (t *Tree) record(ino uint64) *record {
+	if ino == 0 || ino > uint64(t.count()) {
+		return nil
+	}
+	off := order.Uint64(t.data[headerSize+8*(ino-1):])
+	return &record{data: t.data, pos: int(off)}
+}
+
+func (r *record) next(n int) []byte {
+	if r.err || n < 0 || r.pos+n > len(r.data) {
+		r.err = true
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *record) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return order.Uint16(b)
+	}
+	return 0
+}
+
+func (r *record) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return order.Uint32(b)
+	}
+	return 0
+}
+
+func (r *record) u64() uint64 {
+	if b := r.next(8); b != nil {
+		return order.Uint64(b)
+	}
+	return 0
+}
+
+// node decodes the fixed part of the record, leaving r at the dirents.
+func (r *record) node(ino uint64) *Node {
+	n := &Node{Ino: ino}
+	n.Mode = r.u32()
+	n.Nlink = r.u32()
+	flags := r.u32()
+	n.Whiteout = flags&flagWhiteout != 0
+	n.Opaque = flags&flagOpaque != 0
+	n.Uid = r.u32()
+	n.Gid = r.u32()
+	n.Size = int64(r.u64())
+	n.Rdev = r.u64()
+	n.Atime = int64(r.u64())
+	n.Mtime = int64(r.u64())
+	n.Ctime = int64(r.u64())
+	n.Sino = r.u64()
+	n.Value = string(r.next(int(r.u32())))
+	for i, count := 0, int(r.u32()); i < count && !r.err; i++ {
+		name := string(r.next(int(r.u16())))
+		value := append([]byte{}, r.next(int(r.u32()))...)
+		if n.Xattrs == nil {
+			n.Xattrs = make(map[string][]byte)
+		}
+		n.Xattrs[name] = value
+	}
+	if r.err {
+		return nil
+	}
+	return n
+}
+
+// dirent decodes the i-th of count dirents, base being the offset of
+// the dirent offset table.
+func (r *record) dirent(base, count, i int) (name []byte, ino uint64) {
+	r.pos = base + 4*i
+	off := int(r.u32())
+	r.pos = base + 4*count + off
+	ino = r.u64()
+	name = r.next(int(r.u16()))
+	return
+}
+
+// find looks up name in the dirents of the record using binary search.
+func (r *record) find(name string) uint64 {
+	count := int(r.u32())
+	base := r.pos
+	i := sort.Search(count, func(i int) bool {
+		s, _ := r.dirent(base, count, i)
+		return string(s) >= name
+	})
+	if r.err || i == count {
+		return 0
+	}
+	s, ino := r.dirent(base, count, i)
+	if r.err || string(s) != name {
+		return 0
+	}
+	return ino
+}
+
+// all decodes every dirent of the record.
+func (r *record) all() map[string]uint64 {
+	count := int(r.u32())
+	base := r.pos
+	dirents := make(map[string]uint64, count)
+	for i := 0; i < count; i++ {
+		name, ino := r.dirent(base, count, i)
+		if r.err {
+			return nil
+		}
+		dirents[string(name)] = ino
+	}
+	return dirents
+}
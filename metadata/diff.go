@@ -0,0 +1,143 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"syscall"
+)
+
+// ChangeKind is the kind of difference between two trees at a path.
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Modified
+	TypeChanged
+)
+
+var changeKindNames = [...]string{
+	Added:       "added",
+	Removed:     "removed",
+	Modified:    "modified",
+	TypeChanged: "type-changed",
+}
+
+func (k ChangeKind) String() string {
+	if int(k) < len(changeKindNames) {
+		return changeKindNames[k]
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+func (k ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *ChangeKind) UnmarshalText(text []byte) error {
+	for i, name := range changeKindNames {
+		if string(text) == name {
+			*k = ChangeKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change kind %q", text)
+}
+
+// Change is a difference between two trees. Added and removed
+// directories are reported once, not for each of their entries.
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+}
+
+// Diff returns the changes from tree a to tree b, ordered by path.
+// Subtrees with equal Merkle hashes are not descended into.
+func Diff(a, b *Tree) ([]Change, error) {
+	d := differ{a: a.merkle(), b: b.merkle()}
+	if err := d.diff("/", 1, 1); err != nil {
+		return nil, err
+	}
+	return d.changes, nil
+}
+
+type differ struct {
+	a, b    *merkle
+	changes []Change
+}
+
+func (d *differ) add(path string, kind ChangeKind) {
+	d.changes = append(d.changes, Change{Path: path, Kind: kind})
+}
+
+func (d *differ) diff(name string, ia, ib uint64) error {
+	ha, err := d.a.hash(ia)
+	if err != nil {
+		return err
+	}
+	hb, err := d.b.hash(ib)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(ha, hb) {
+		return nil
+	}
+	na, nb := d.a.t.node(ia), d.b.t.node(ib)
+	if na.Mode&syscall.S_IFMT != nb.Mode&syscall.S_IFMT {
+		d.add(name, TypeChanged)
+		return nil
+	}
+	if !na.IsDir() {
+		d.add(name, Modified)
+		return nil
+	}
+	if !sameAttrs(na, nb) {
+		d.add(name, Modified)
+	}
+	da, db := d.a.t.dirents(ia), d.b.t.dirents(ib)
+	names := make([]string, 0, len(da)+len(db))
+	for n := range da {
+		names = append(names, n)
+	}
+	for n := range db {
+		if _, ok := da[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if n == "." || n == ".." {
+			continue
+		}
+		ca, cb := da[n], db[n]
+		p := path.Join(name, n)
+		switch {
+		case cb == 0:
+			d.add(p, Removed)
+		case ca == 0:
+			d.add(p, Added)
+		default:
+			if err := d.diff(p, ca, cb); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sameAttrs reports whether a and b have the same hashed attributes,
+// ignoring their content.
+func sameAttrs(a, b *Node) bool {
+	if a.Mode != b.Mode || a.Uid != b.Uid || a.Gid != b.Gid || a.Rdev != b.Rdev ||
+		len(a.Xattrs) != len(b.Xattrs) {
+		return false
+	}
+	for name, value := range a.Xattrs {
+		if v, ok := b.Xattrs[name]; !ok || !bytes.Equal(v, value) {
+			return false
+		}
+	}
+	return true
+}
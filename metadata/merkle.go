@@ -0,0 +1,114 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"sort"
+)
+
+// The Merkle hash of a node covers its mode, owner, group, device
+// number, layer markers, xattrs and content: the value of regular files
+// and symlinks, and the names and hashes of the entries of directories,
+// in name order.
+// Inode numbers, link counts and times are left out, so building the
+// same files twice gives the same hash.
+
+// merkle computes node hashes, remembering them so that each node
+// is hashed once.
+type merkle struct {
+	t    *Tree
+	memo map[uint64][]byte
+}
+
+func (t *Tree) merkle() *merkle {
+	return &merkle{t: t, memo: make(map[uint64][]byte)}
+}
+
+func (m *merkle) hash(ino uint64) ([]byte, error) {
+	if sum, ok := m.memo[ino]; ok {
+		return sum, nil
+	}
+	n := m.t.node(ino)
+	if n == nil {
+		return nil, errCorrupt
+	}
+	h := sha256.New()
+	writeUint(h, uint64(n.Mode))
+	writeUint(h, uint64(n.Uid))
+	writeUint(h, uint64(n.Gid))
+	writeUint(h, n.Rdev)
+	var flags uint64
+	if n.Whiteout {
+		flags |= flagWhiteout
+	}
+	if n.Opaque {
+		flags |= flagOpaque
+	}
+	writeUint(h, flags)
+	xnames := make([]string, 0, len(n.Xattrs))
+	for name := range n.Xattrs {
+		xnames = append(xnames, name)
+	}
+	sort.Strings(xnames)
+	writeUint(h, uint64(len(xnames)))
+	for _, name := range xnames {
+		writeBytes(h, []byte(name))
+		writeBytes(h, n.Xattrs[name])
+	}
+	if n.IsDir() {
+		dirents := m.t.dirents(ino)
+		names := make([]string, 0, len(dirents))
+		for name := range dirents {
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		writeUint(h, uint64(len(names)))
+		for _, name := range names {
+			sum, err := m.hash(dirents[name])
+			if err != nil {
+				return nil, err
+			}
+			writeBytes(h, []byte(name))
+			writeBytes(h, sum)
+		}
+	} else {
+		writeBytes(h, []byte(n.Value))
+	}
+	sum := h.Sum(nil)
+	m.memo[ino] = sum
+	return sum, nil
+}
+
+func writeUint(h hash.Hash, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	h.Write(b[:])
+}
+
+func writeBytes(h hash.Hash, b []byte) {
+	writeUint(h, uint64(len(b)))
+	h.Write(b)
+}
+
+// Hash returns the hex encoded Merkle hash of the subtree at path.
+func (t *Tree) Hash(path string) (string, error) {
+	ino := t.resolve(path)
+	if ino == 0 {
+		return "", errors.New("file not exist")
+	}
+	sum, err := t.merkle().hash(ino)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// RootHash returns the hex encoded Merkle hash of the whole tree.
+func (t *Tree) RootHash() (string, error) {
+	return t.Hash("/")
+}
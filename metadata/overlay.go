@@ -0,0 +1,255 @@
+package metadata
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Overlay presents the union of several trees. Entries of upper layers
+// shadow those of lower layers, and directories present in several
+// layers are merged, unless a whiteout or an opaque directory in an
+// upper layer hides the lower ones.
+type Overlay struct {
+	layers []*Tree // uppermost first
+	nlinks *nlinkCache
+}
+
+// nlinkCache holds the link counts of merged directories, by their
+// uppermost entry, as counting their subdirectories takes a lookup in
+// every layer for every entry.
+type nlinkCache struct {
+	mu sync.Mutex
+	m  map[entry]uint32
+}
+
+// layerShift places the layer index in the inode numbers of an overlay,
+// so inodes of different layers do not collide.
+const layerShift = 48
+
+// NewOverlay returns an overlay of trees, uppermost first.
+func NewOverlay(trees ...*Tree) *Overlay {
+	return &Overlay{layers: trees, nlinks: &nlinkCache{}}
+}
+
+// Restore replaces the overlay with the metadata files, uppermost first.
+func (o *Overlay) Restore(filenames ...string) error {
+	return o.restore(filenames, nil, false)
+}
+
+// RestoreSigned is like Restore, but fails unless every metadata file
+// is signed by one of keys.
+func (o *Overlay) RestoreSigned(keys []ed25519.PublicKey, filenames ...string) error {
+	return o.restore(filenames, keys, true)
+}
+
+func (o *Overlay) restore(filenames []string, keys []ed25519.PublicKey, signed bool) error {
+	o.Close()
+	o.nlinks = &nlinkCache{}
+	for _, filename := range filenames {
+		t := &Tree{}
+		var err error
+		if signed {
+			err = t.RestoreSigned(filename, keys)
+		} else {
+			err = t.Restore(filename)
+		}
+		if err != nil {
+			o.Close()
+			return err
+		}
+		o.layers = append(o.layers, t)
+	}
+	return nil
+}
+
+// Close releases all layers, leaving the overlay empty.
+func (o *Overlay) Close() error {
+	var err error
+	for _, t := range o.layers {
+		if e := t.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	o.layers = nil
+	o.nlinks = nil
+	return err
+}
+
+// Layers returns the trees of the overlay, uppermost first.
+func (o *Overlay) Layers() []*Tree {
+	return o.layers
+}
+
+// entry is a node in one layer of an overlay.
+type entry struct {
+	layer int
+	ino   uint64
+}
+
+// resolve returns the entries making up path, uppermost first. Only
+// directories have more than one entry.
+func (o *Overlay) resolve(path string) []entry {
+	var stack []entry
+	for i, t := range o.layers {
+		root := t.node(1)
+		if root == nil {
+			continue
+		}
+		stack = append(stack, entry{i, 1})
+		if root.Opaque {
+			break
+		}
+	}
+	path = filepath.Clean(path)
+	for _, name := range strings.Split(path, string(filepath.Separator)) {
+		if name == "" || name == "." {
+			continue
+		}
+		if stack = o.child(stack, name); stack == nil {
+			return nil
+		}
+	}
+	return stack
+}
+
+// child returns the entries of name in the merged directory stack.
+func (o *Overlay) child(stack []entry, name string) []entry {
+	var next []entry
+	for _, e := range stack {
+		t := o.layers[e.layer]
+		ino := t.child(e.ino, name)
+		if ino == 0 {
+			continue
+		}
+		n := t.node(ino)
+		if n == nil || n.Whiteout {
+			break
+		}
+		if !n.IsDir() {
+			if next == nil {
+				next = append(next, entry{e.layer, ino})
+			}
+			break
+		}
+		next = append(next, entry{e.layer, ino})
+		if n.Opaque {
+			break
+		}
+	}
+	return next
+}
+
+// node returns the uppermost node of the entries, numbered for the overlay.
+func (o *Overlay) node(stack []entry) *Node {
+	if len(stack) == 0 {
+		return nil
+	}
+	n := o.layers[stack[0].layer].node(stack[0].ino)
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.Ino |= uint64(stack[0].layer) << layerShift
+	return &c
+}
+
+// names returns the merged entry names of a directory stack.
+func (o *Overlay) names(stack []entry) (names []string) {
+	seen := make(map[string]bool)
+	for _, e := range stack {
+		t := o.layers[e.layer]
+		for name, ino := range t.dirents(e.ino) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if n := t.node(ino); n != nil && !n.Whiteout {
+				names = append(names, name)
+			}
+		}
+	}
+	return
+}
+
+func (o *Overlay) ListDir(path string) []string {
+	stack := o.resolve(path)
+	if n := o.node(stack); n == nil || !n.IsDir() {
+		return nil
+	}
+	return o.names(stack)
+}
+
+func (o *Overlay) Stat(path string, stat *syscall.Stat_t) error {
+	stack := o.resolve(path)
+	if err := o.node(stack).stat(stat); err != nil {
+		return err
+	}
+	if len(stack) > 1 {
+		stat.Nlink = uint64(o.nlink(stack))
+	}
+	return nil
+}
+
+// nlink returns the link count of the merged directory stack.
+func (o *Overlay) nlink(stack []entry) uint32 {
+	if c := o.nlinks; c != nil {
+		c.mu.Lock()
+		nlink, ok := c.m[stack[0]]
+		c.mu.Unlock()
+		if ok {
+			return nlink
+		}
+	}
+	// count subdirectories of the merged directory
+	var nlink uint32 = 2
+	for _, name := range o.names(stack) {
+		if name == "." || name == ".." {
+			continue
+		}
+		if c := o.child(stack, name); c != nil && o.node(c[:1]).IsDir() {
+			nlink++
+		}
+	}
+	if c := o.nlinks; c != nil {
+		c.mu.Lock()
+		if c.m == nil {
+			c.m = make(map[entry]uint32)
+		}
+		c.m[stack[0]] = nlink
+		c.mu.Unlock()
+	}
+	return nlink
+}
+
+func (o *Overlay) GetLink(path string) (lnk string, errc int) {
+	return o.node(o.resolve(path)).link()
+}
+
+func (o *Overlay) GetHash(path string) (hash string, errc int) {
+	return o.node(o.resolve(path)).hash()
+}
+
+func (o *Overlay) GetXattr(path string, name string) (value []byte, errc int) {
+	return o.node(o.resolve(path)).getXattr(name)
+}
+
+func (o *Overlay) ListXattr(path string) (names []string, errc int) {
+	return o.node(o.resolve(path)).listXattr()
+}
+
+// Usage returns the sum of the Usage of the layers, counting entries
+// shadowed by upper layers too.
+func (o *Overlay) Usage() (size int64, inodes uint64, err error) {
+	for _, t := range o.layers {
+		s, i, err := t.Usage()
+		if err != nil {
+			return 0, 0, err
+		}
+		size += s
+		inodes += i
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The signature of a metadata file is kept next to it, hex encoded,
+// in a file named with SignatureSuffix appended. It signs the contents
+// of the metadata file as is.
+const SignatureSuffix = ".sig"
+
+var (
+	ErrUnsigned     = errors.New("metadata is not signed")
+	ErrBadSignature = errors.New("metadata signature does not match any trusted key")
+)
+
+// ParsePublicKey parses a hex encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", s)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// ReadPrivateKey reads a hex encoded ed25519 private key, or its seed,
+// from filename.
+func ReadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid private key", filename)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, fmt.Errorf("%s: invalid private key", filename)
+}
+
+// SignFile signs the metadata in filename with key.
+func SignFile(filename string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	sig := hex.EncodeToString(ed25519.Sign(key, data)) + "\n"
+	return os.WriteFile(filename+SignatureSuffix, []byte(sig), os.FileMode(0644))
+}
+
+// verify checks that data, read from filename, is signed by one of keys.
+func verify(filename string, data []byte, keys []ed25519.PublicKey) error {
+	text, err := os.ReadFile(filename + SignatureSuffix)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", filename, ErrUnsigned)
+	} else if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("%s: %w", filename, ErrBadSignature)
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w", filename, ErrBadSignature)
+}
+
+// RestoreSigned is like Restore, but fails unless the metadata is
+// signed by one of keys. The metadata is read into memory rather than
+// mapped, so that it cannot change once verified.
+func (t *Tree) RestoreSigned(filename string, keys []ed25519.PublicKey) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := verify(filename, data, keys); err != nil {
+		return err
+	}
+	return t.Load(data)
+}
@@ -3,53 +3,242 @@ package metadata
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 )
 
 type Tree struct {
 	nodes []Node
+	// data holds binary metadata, in which case nodes is empty and
+	// nodes are decoded on demand.
+	data   []byte
+	mapped bool
 }
 
 func (t *Tree) NewNode(stat *syscall.Stat_t) *Node {
 	i := len(t.nodes)
 	t.nodes = append(t.nodes, Node{
-		Ino:  uint64(i) + 1,
-		Mode: stat.Mode,
-		Size: stat.Size,
+		Ino:   uint64(i) + 1,
+		Mode:  stat.Mode,
+		Nlink: 1,
+		Uid:   stat.Uid,
+		Gid:   stat.Gid,
+		Size:  stat.Size,
+		Rdev:  stat.Rdev,
+		Atime: stat.Atim.Nano(),
+		Mtime: stat.Mtim.Nano(),
+		Ctime: stat.Ctim.Nano(),
+		Sino:  stat.Ino,
 	})
 	return &t.nodes[i]
 }
 
+// Dump returns the tree in JSON metadata format.
 func (t *Tree) Dump() ([]byte, error) {
-	return json.Marshal(t.nodes)
+	if t.data == nil {
+		return json.Marshal(t.nodes)
+	}
+	nodes := make([]Node, t.count())
+	for i := range nodes {
+		n := t.node(uint64(i) + 1)
+		if n == nil {
+			return nil, errCorrupt
+		}
+		nodes[i] = *n
+		nodes[i].Dirents = t.dirents(n.Ino)
+	}
+	return json.Marshal(nodes)
 }
 
+// Load replaces the tree with metadata in either format.
 func (t *Tree) Load(data []byte) error {
+	t.Close()
+	if len(data) >= len(magic) && string(data[:len(magic)]) == magic {
+		if err := checkHeader(data); err != nil {
+			return err
+		}
+		t.data = data
+		return nil
+	}
 	return json.Unmarshal(data, &t.nodes)
 }
 
+// Save writes the tree to filename in binary metadata format.
 func (t *Tree) Save(filename string) error {
-	data, err := t.Dump()
+	return t.SaveAs(filename, FormatBinary)
+}
+
+// SaveAs writes the tree to filename in format. The file is replaced
+// rather than rewritten, so that trees restored from it are unaffected.
+func (t *Tree) SaveAs(filename string, format Format) (err error) {
+	var data []byte
+	switch format {
+	case FormatBinary:
+		data, err = t.Encode()
+	case FormatJSON:
+		data, err = t.Dump()
+	default:
+		err = errors.New("unknown metadata format")
+	}
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, data, os.FileMode(0644))
+	return writeFile(filename, data)
 }
 
+// writeFile writes data to filename through a temporary file renamed
+// into place.
+func writeFile(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp makes files private
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Restore replaces the tree with the metadata in filename.
+// Binary metadata is mapped into memory rather than read, so the file
+// must not be modified until Close, only replaced as SaveAs does.
 func (t *Tree) Restore(filename string) error {
-	data, err := os.ReadFile(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
-	return t.Load(data)
+	defer f.Close()
+	head := make([]byte, len(magic))
+	if _, err := f.ReadAt(head, 0); err != nil || string(head) != magic {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return t.Load(data)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if err := checkHeader(data); err != nil {
+		syscall.Munmap(data)
+		return err
+	}
+	t.Close()
+	t.data, t.mapped = data, true
+	return nil
+}
+
+// Close releases the metadata held by the tree, leaving it empty.
+func (t *Tree) Close() error {
+	var err error
+	if t.mapped {
+		err = syscall.Munmap(t.data)
+	}
+	*t = Tree{}
+	return err
+}
+
+func (t *Tree) count() int {
+	if t.data != nil {
+		return int(order.Uint64(t.data[16:]))
+	}
+	return len(t.nodes)
+}
+
+// node returns the node numbered ino. Nodes decoded from binary
+// metadata carry no Dirents, use dirents or child for those.
+func (t *Tree) node(ino uint64) *Node {
+	if ino == 0 || ino > uint64(t.count()) {
+		return nil
+	}
+	if t.data != nil {
+		return t.record(ino).node(ino)
+	}
+	return &t.nodes[ino-1]
+}
+
+func (t *Tree) dirents(ino uint64) map[string]uint64 {
+	if t.data != nil {
+		r := t.record(ino)
+		if r == nil || r.node(ino) == nil {
+			return nil
+		}
+		return r.all()
+	}
+	if n := t.node(ino); n != nil {
+		return n.Dirents
+	}
+	return nil
+}
+
+func (t *Tree) child(ino uint64, name string) uint64 {
+	if t.data != nil {
+		r := t.record(ino)
+		if r == nil || r.node(ino) == nil {
+			return 0
+		}
+		return r.find(name)
+	}
+	if n := t.node(ino); n != nil {
+		return n.Dirents[name]
+	}
+	return 0
 }
 
 func (t *Tree) Build(root string, toValue func(path string) string) error {
+	return t.BuildWith(root, BuildOptions{}, toValue)
+}
+
+// Rebuild is like Build, but reuses the values of regular files from
+// prev, if their size, mtime, ctime and source inode are unchanged,
+// instead of calling toValue. prev must not be t.
+func (t *Tree) Rebuild(root string, prev *Tree, toValue func(path string) string) error {
+	return t.BuildWith(root, BuildOptions{Prev: prev}, toValue)
+}
+
+type BuildOptions struct {
+	// Prev is a previous tree of root. Values of regular files are
+	// reused from it, instead of calling toValue, if their size, mtime,
+	// ctime and source inode are unchanged. Prev must not be the tree
+	// being built.
+	Prev *Tree
+	// Reused, if not nil, is called with the path and value of each
+	// file whose value is reused from Prev, such as to make sure its
+	// object is still stored. It runs like toValue, see Jobs.
+	Reused func(path, value string)
+	// Jobs is the number of concurrent toValue calls, which must then
+	// be safe for concurrent use. Nodes are numbered in walk order
+	// regardless.
+	Jobs int
+	// Layer makes root an OCI layer: regular files named with
+	// WhiteoutPrefix are recorded as whiteouts, and OpaqueMarker makes
+	// its directory opaque. Otherwise they are ordinary files.
+	Layer bool
+}
+
+func (t *Tree) BuildWith(root string, opts BuildOptions, toValue func(path string) string) error {
 	if oldwd, err := os.Getwd(); err != nil {
 		return err
 	} else {
@@ -58,128 +247,340 @@ func (t *Tree) Build(root string, toValue func(path string) string) error {
 	if err := os.Chdir(root); err != nil {
 		return err
 	}
-	*t = Tree{}
-	return filepath.Walk(".", func(path string, info fs.FileInfo, err error) error {
+	t.Close()
+	values := newValuer(opts.Jobs)
+	// inodes of files with multiple links, to share their nodes
+	links := make(map[[2]uint64]uint64)
+	err := filepath.Walk(".", func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		node := t.NewNode(info.Sys().(*syscall.Stat_t))
+		dir, file := filepath.Split(path)
+		stat := info.Sys().(*syscall.Stat_t)
+		if opts.Layer && strings.HasPrefix(file, WhiteoutPrefix) {
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("%q: marker is not a regular file", path)
+			}
+			if file == OpaqueMarker {
+				t.lookup(dir).Opaque = true
+				return nil
+			}
+			node := t.NewNode(stat)
+			node.Whiteout = true
+			t.lookup(dir).Dirents[strings.TrimPrefix(file, WhiteoutPrefix)] = node.Ino
+			return nil
+		}
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if ino := links[key]; ino != 0 {
+			node := &t.nodes[ino-1]
+			node.Nlink++
+			t.lookup(dir).Dirents[file] = node.Ino
+			return nil
+		}
+		node := t.NewNode(stat)
+		if !info.IsDir() && stat.Nlink > 1 {
+			links[key] = node.Ino
+		}
 		if info.IsDir() {
+			node.Nlink = 2
 			node.Dirents = make(map[string]uint64)
 			node.Dirents["."] = node.Ino
 		} else if info.Mode().IsRegular() {
-			node.Value = toValue(path)
+			if old := opts.Prev.unchanged(path, node); old == nil {
+				values.add(node.Ino, path, toValue)
+			} else if opts.Reused == nil {
+				node.Value = old.Value
+			} else {
+				value := old.Value
+				values.add(node.Ino, path, func(path string) string {
+					opts.Reused(path, value)
+					return value
+				})
+			}
 		} else if info.Mode()&fs.ModeSymlink != 0 {
 			node.Value, _ = os.Readlink(path)
-		} else {
+		} else if !node.IsSpecial() {
 			log.Printf("[WARN] %q: unexpected file type", path)
 		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			node.Xattrs = readXattrs(path)
+		}
 		if path != "." {
-			dir, file := filepath.Split(path)
 			parent := t.lookup(dir)
 			parent.Dirents[file] = node.Ino
 			if node.IsDir() {
 				node.Dirents[".."] = parent.Ino
+				parent.Nlink++
 			}
 		} else {
 			node.Dirents[".."] = node.Ino
 		}
 		return nil
 	})
+	for ino, value := range values.wait() {
+		t.nodes[ino-1].Value = value
+	}
+	return err
 }
 
-func (t *Tree) lookup(path string) *Node {
+// valuer calls toValue for paths, on jobs goroutines.
+type valuer struct {
+	paths  chan valuerJob
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	values map[uint64]string
+}
+
+type valuerJob struct {
+	ino     uint64
+	path    string
+	toValue func(path string) string
+}
+
+func newValuer(jobs int) *valuer {
+	v := &valuer{values: make(map[uint64]string)}
+	if jobs > 1 {
+		v.paths = make(chan valuerJob, jobs)
+		v.wg.Add(jobs)
+		for i := 0; i < jobs; i++ {
+			go func() {
+				defer v.wg.Done()
+				for job := range v.paths {
+					v.set(job.ino, job.toValue(job.path))
+				}
+			}()
+		}
+	}
+	return v
+}
+
+func (v *valuer) set(ino uint64, value string) {
+	v.mu.Lock()
+	v.values[ino] = value
+	v.mu.Unlock()
+}
+
+func (v *valuer) add(ino uint64, path string, toValue func(path string) string) {
+	if v.paths == nil {
+		v.set(ino, toValue(path))
+	} else {
+		v.paths <- valuerJob{ino, path, toValue}
+	}
+}
+
+// wait returns the values of all added paths by inode number.
+func (v *valuer) wait() map[uint64]string {
+	if v.paths != nil {
+		close(v.paths)
+		v.wg.Wait()
+	}
+	return v.values
+}
+
+// unchanged returns the regular file at path in t if it matches n,
+// or nil. t may be nil.
+func (t *Tree) unchanged(path string, n *Node) *Node {
+	if t == nil {
+		return nil
+	}
+	old := t.lookup(path)
+	if old == nil || !old.IsReg() || old.Sino == 0 || old.Sino != n.Sino ||
+		old.Size != n.Size || old.Mtime != n.Mtime || old.Ctime != n.Ctime {
+		return nil
+	}
+	return old
+}
+
+func (t *Tree) resolve(path string) uint64 {
 	path = filepath.Clean(path)
-	i := 0
+	ino := uint64(1)
 	for _, name := range strings.Split(path, string(filepath.Separator)) {
 		if name == "" {
 			continue
 		}
-		ino := t.nodes[i].Dirents[name]
-		if ino == 0 {
-			return nil
+		if ino = t.child(ino, name); ino == 0 {
+			return 0
 		}
-		i = int(ino - 1)
 	}
-	return &t.nodes[i]
+	return ino
+}
+
+func (t *Tree) lookup(path string) *Node {
+	ino := t.resolve(path)
+	if ino == 0 {
+		return nil
+	}
+	return t.node(ino)
 }
 
 func (t *Tree) ListDir(path string) (names []string) {
-	dir := t.lookup(path)
-	if dir == nil {
+	ino := t.resolve(path)
+	if ino == 0 {
 		return
 	}
-	for name := range dir.Dirents {
+	for name := range t.dirents(ino) {
 		names = append(names, name)
 	}
 	return
 }
 
 func (t *Tree) Stat(path string, stat *syscall.Stat_t) error {
-	file := t.lookup(path)
-	if file == nil {
-		return errors.New("file not exist")
-	}
-	file.Stat(stat)
-	stat.Nlink = 1
-	stat.Blksize = 4096
-	stat.Blocks = stat.Size / stat.Blksize
-	if stat.Size%stat.Blksize > 0 {
-		stat.Blocks++
-	}
-	return nil
+	return t.lookup(path).stat(stat)
 }
 
 func (t *Tree) GetLink(path string) (lnk string, errc int) {
-	file := t.lookup(path)
-	if file == nil {
-		errc = -int(syscall.ENOENT)
-		return
-	}
-	if !file.IsLnk() {
-		errc = -int(syscall.EINVAL)
-		return
-	}
-	lnk = file.Value
-	return
+	return t.lookup(path).link()
 }
 
 func (t *Tree) GetHash(path string) (hash string, errc int) {
-	file := t.lookup(path)
-	if file == nil {
-		errc = -int(syscall.ENOENT)
-		return
-	}
-	if !file.IsReg() {
-		errc = -int(syscall.EINVAL)
-		return
-	}
-	hash = file.Value
-	return
+	return t.lookup(path).hash()
 }
 
 type Node struct {
 	Ino     uint64            `json:"ino"`
 	Mode    uint32            `json:"mode"`
+	Nlink   uint32            `json:"nlink,omitempty"`
+	Uid     uint32            `json:"uid,omitempty"`
+	Gid     uint32            `json:"gid,omitempty"`
 	Size    int64             `json:"size"`
+	Rdev    uint64            `json:"rdev,omitempty"`
+	Atime   int64             `json:"atime,omitempty"`
+	Mtime   int64             `json:"mtime,omitempty"`
+	Ctime   int64             `json:"ctime,omitempty"`
+	Sino    uint64            `json:"sino,omitempty"` // inode of the source file
 	Value   string            `json:"value,omitempty"`
+	Xattrs  map[string][]byte `json:"xattrs,omitempty"`
 	Dirents map[string]uint64 `json:"dirents,omitempty"`
+
+	// Whiteout marks a file removed from lower layers, Opaque a
+	// directory hiding the contents of lower layers, see Overlay.
+	Whiteout bool `json:"whiteout,omitempty"`
+	Opaque   bool `json:"opaque,omitempty"`
 }
 
+// OCI layer markers, recorded by Build as Whiteout and Opaque.
+const (
+	WhiteoutPrefix = ".wh."
+	OpaqueMarker   = ".wh..wh..opq"
+)
+
 func (n *Node) IsDir() bool {
-	return n.Mode&syscall.S_IFDIR != 0
+	return n.Mode&syscall.S_IFMT == syscall.S_IFDIR
 }
 
 func (n *Node) IsLnk() bool {
-	return n.Mode&syscall.S_IFLNK != 0
+	return n.Mode&syscall.S_IFMT == syscall.S_IFLNK
 }
 
 func (n *Node) IsReg() bool {
-	return n.Mode&syscall.S_IFREG != 0
+	return n.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// IsSpecial reports whether n is a device, FIFO or socket.
+func (n *Node) IsSpecial() bool {
+	switch n.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		return true
+	}
+	return false
 }
 
 func (n *Node) Stat(stat *syscall.Stat_t) {
 	stat.Ino = n.Ino
 	stat.Mode = n.Mode
+	stat.Nlink = uint64(n.Nlink)
+	stat.Uid = n.Uid
+	stat.Gid = n.Gid
 	stat.Size = n.Size
+	stat.Rdev = n.Rdev
+	stat.Atim = syscall.NsecToTimespec(n.Atime)
+	stat.Mtim = syscall.NsecToTimespec(n.Mtime)
+	stat.Ctim = syscall.NsecToTimespec(n.Ctime)
+}
+
+// The methods below report on a looked up node, and fail with
+// ENOENT if it is nil.
+
+func (n *Node) stat(stat *syscall.Stat_t) error {
+	if n == nil {
+		return errors.New("file not exist")
+	}
+	n.Stat(stat)
+	if stat.Nlink == 0 {
+		// metadata from before link counts were recorded
+		stat.Nlink = 1
+	}
+	stat.Blksize = 4096
+	stat.Blocks = stat.Size / stat.Blksize
+	if stat.Size%stat.Blksize > 0 {
+		stat.Blocks++
+	}
+	return nil
+}
+
+func (n *Node) link() (lnk string, errc int) {
+	if n == nil {
+		errc = -int(syscall.ENOENT)
+		return
+	}
+	if !n.IsLnk() {
+		errc = -int(syscall.EINVAL)
+		return
+	}
+	lnk = n.Value
+	return
+}
+
+func (n *Node) hash() (hash string, errc int) {
+	if n == nil {
+		errc = -int(syscall.ENOENT)
+		return
+	}
+	if !n.IsReg() {
+		switch {
+		case n.IsDir():
+			errc = -int(syscall.EISDIR)
+		case n.IsSpecial():
+			errc = -int(syscall.ENXIO)
+		default:
+			errc = -int(syscall.EINVAL)
+		}
+		return
+	}
+	hash = n.Value
+	return
+}
+
+// WalkObjects calls fn with the value of each regular file, that is
+// the hash of each object the tree refers to. Hard links are visited once.
+func (t *Tree) WalkObjects(fn func(hash string)) error {
+	for ino := uint64(1); ino <= uint64(t.count()); ino++ {
+		n := t.node(ino)
+		if n == nil {
+			return errCorrupt
+		}
+		if n.IsReg() && !n.Whiteout && n.Value != "" {
+			fn(n.Value)
+		}
+	}
+	return nil
+}
+
+// Usage returns the total size of the regular files in the tree and
+// its number of inodes. Hard links count once, whiteouts not at all.
+func (t *Tree) Usage() (size int64, inodes uint64, err error) {
+	for ino := uint64(1); ino <= uint64(t.count()); ino++ {
+		n := t.node(ino)
+		if n == nil {
+			return 0, 0, errCorrupt
+		}
+		if n.Whiteout {
+			continue
+		}
+		inodes++
+		if n.IsReg() {
+			size += n.Size
+		}
+	}
+	return
 }
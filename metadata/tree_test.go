@@ -0,0 +1,501 @@
+package metadata
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func buildTestTree(t *testing.T) *Tree {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a/f", filepath.Join(root, "l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a", "f"), filepath.Join(root, "h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "p"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree := &Tree{}
+	if err := tree.Build(root, func(path string) string { return "hash:" + path }); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func checkTestTree(t *testing.T, tree *Tree) {
+	names := tree.ListDir("/a")
+	sort.Strings(names)
+	if want := []string{".", "..", "b", "f"}; len(names) != len(want) {
+		t.Errorf("ListDir = %v, want %v", names, want)
+	} else {
+		for i := range want {
+			if names[i] != want[i] {
+				t.Errorf("ListDir = %v, want %v", names, want)
+				break
+			}
+		}
+	}
+	var stat syscall.Stat_t
+	if err := tree.Stat("/a/f", &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 5 || stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("Stat = size %d mode %o", stat.Size, stat.Mode)
+	}
+	if stat.Uid != uint32(os.Getuid()) || stat.Mtim.Sec == 0 {
+		t.Errorf("Stat = uid %d mtime %v", stat.Uid, stat.Mtim)
+	}
+	if stat.Nlink != 2 {
+		t.Errorf("Stat of hard link: nlink %d", stat.Nlink)
+	}
+	ino := stat.Ino
+	if tree.Stat("/h", &stat) != nil || stat.Ino != ino {
+		t.Errorf("hard links have different inodes")
+	}
+	if tree.Stat("/a", &stat) != nil || stat.Nlink != 3 {
+		t.Errorf("Stat of directory: nlink %d", stat.Nlink)
+	}
+	if hash, errc := tree.GetHash("/a/f"); errc != 0 || hash != "hash:a/f" {
+		t.Errorf("GetHash = %q, %d", hash, errc)
+	}
+	if lnk, errc := tree.GetLink("/l"); errc != 0 || lnk != "a/f" {
+		t.Errorf("GetLink = %q, %d", lnk, errc)
+	}
+	if tree.Stat("/p", &stat) != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		t.Errorf("Stat of FIFO: mode %o", stat.Mode)
+	}
+	if _, errc := tree.GetHash("/p"); errc != -int(syscall.ENXIO) {
+		t.Errorf("GetHash of FIFO = %d", errc)
+	}
+	if tree.Stat("/a/missing", &stat) == nil {
+		t.Errorf("Stat of missing file succeeded")
+	}
+}
+
+func TestSaveRestore(t *testing.T) {
+	tree := buildTestTree(t)
+	checkTestTree(t, tree)
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		file := filepath.Join(t.TempDir(), "meta")
+		if err := tree.SaveAs(file, format); err != nil {
+			t.Fatal(err)
+		}
+		restored := &Tree{}
+		if err := restored.Restore(file); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		checkTestTree(t, restored)
+
+		// convert back to the other format
+		data, err := restored.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted := &Tree{}
+		if err := converted.Load(data); err != nil {
+			t.Fatal(err)
+		}
+		checkTestTree(t, converted)
+		restored.Close()
+	}
+}
+
+func TestSaveOverRestored(t *testing.T) {
+	tree := buildTestTree(t)
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := tree.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	restored := &Tree{}
+	if err := restored.Restore(file); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	empty := &Tree{}
+	if err := empty.Build(t.TempDir(), func(path string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	checkTestTree(t, restored)
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("saved file: %v, %v", info, err)
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := os.WriteFile(file, []byte(magic+"garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree := &Tree{}
+	if tree.Restore(file) == nil {
+		t.Errorf("Restore of corrupt metadata succeeded")
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	data, err := buildTestTree(t).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order.PutUint32(data[8:], version+1)
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree := &Tree{}
+	if tree.Restore(file) == nil {
+		t.Errorf("Restore of metadata version %d succeeded", version+1)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "f")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(file, "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	tree := &Tree{}
+	if err := tree.Build(root, func(path string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	meta := filepath.Join(t.TempDir(), "meta")
+	if err := tree.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Restore(meta); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if names, errc := tree.ListXattr("/f"); errc != 0 || len(names) != 1 || names[0] != "user.test" {
+		t.Errorf("ListXattr = %v, %d", names, errc)
+	}
+	if value, errc := tree.GetXattr("/f", "user.test"); errc != 0 || string(value) != "value" {
+		t.Errorf("GetXattr = %q, %d", value, errc)
+	}
+	if _, errc := tree.GetXattr("/f", "user.missing"); errc != -int(syscall.ENODATA) {
+		t.Errorf("GetXattr of missing attribute = %d", errc)
+	}
+}
+
+func TestHash(t *testing.T) {
+	tree := buildTestTree(t)
+	other := buildTestTree(t)
+	h1, err := tree.RootHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2, err := other.RootHash(); err != nil || h1 != h2 {
+		t.Errorf("RootHash of identical trees: %q != %q", h1, h2)
+	}
+
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := tree.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Restore(file); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if h2, err := other.RootHash(); err != nil || h1 != h2 {
+		t.Errorf("RootHash after Restore: %q != %q", h1, h2)
+	}
+
+	tree.lookup("/a/f").Value = "changed"
+	h2, err := tree.RootHash()
+	if err != nil || h1 == h2 {
+		t.Errorf("RootHash unchanged after modification")
+	}
+	s1, _ := tree.Hash("/a/b")
+	s2, _ := other.Hash("/a/b")
+	if s1 != s2 {
+		t.Errorf("subtree hash changed by unrelated modification")
+	}
+}
+
+func TestWalkObjects(t *testing.T) {
+	tree := buildTestTree(t)
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := tree.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	var restored Tree
+	if err := restored.Restore(file); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var objects []string
+	if err := restored.WalkObjects(func(hash string) {
+		objects = append(objects, hash)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the hard link shares its node, the rest have no objects
+	if want := []string{tree.lookup("/a/f").Value}; !reflect.DeepEqual(objects, want) {
+		t.Errorf("WalkObjects = %q, want %q", objects, want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tree := buildTestTree(t)
+	size, inodes, err := tree.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /, /a, /a/b, /a/f linked as /h, /l and /p
+	if size != 5 || inodes != 6 {
+		t.Errorf("Usage = %d, %d, want 5, 6", size, inodes)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := buildTestTree(t)
+	b := buildTestTree(t)
+	if changes, err := Diff(a, b); err != nil || len(changes) != 0 {
+		t.Errorf("Diff of identical trees = %v, %v", changes, err)
+	}
+
+	b.lookup("/a/f").Value = "changed"
+	delete(b.lookup("/a").Dirents, "b")
+	b.lookup("/").Dirents["new"] = b.resolve("/p")
+	b.lookup("/l").Mode = syscall.S_IFREG | 0644
+
+	changes, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"/a/b", Removed},
+		{"/a/f", Modified},
+		{"/h", Modified}, // hard link to /a/f
+		{"/l", TypeChanged},
+		{"/new", Added},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Diff = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Diff = %v, want %v", changes, want)
+			break
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	lower := buildTestTree(t)
+
+	root := t.TempDir()
+	for _, dir := range []string{"a", "c"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a/new", "a/.wh.f", "c/" + OpaqueMarker, "l"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upper := &Tree{}
+	toValue := func(path string) string { return "upper:" + path }
+	if err := upper.BuildWith(root, BuildOptions{Layer: true}, toValue); err != nil {
+		t.Fatal(err)
+	}
+	if !upper.lookup("/c").Opaque || !upper.lookup("/a/f").Whiteout {
+		t.Fatalf("layer markers not recorded")
+	}
+
+	o := NewOverlay(upper, lower)
+	names := o.ListDir("/a")
+	sort.Strings(names)
+	if want := []string{".", "..", "b", "new"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("ListDir = %v, want %v", names, want)
+	}
+	var stat syscall.Stat_t
+	if o.Stat("/a/f", &stat) == nil {
+		t.Errorf("whiteout file visible")
+	}
+	if o.Stat("/a/b", &stat) != nil {
+		t.Errorf("lower directory not visible")
+	}
+	for i := 0; i < 2; i++ {
+		// the second time from the cache
+		if o.Stat("/a", &stat) != nil || stat.Nlink != 3 {
+			t.Errorf("Stat of merged directory: nlink %d", stat.Nlink)
+		}
+	}
+	if hash, errc := o.GetHash("/l"); errc != 0 || hash != "upper:l" {
+		t.Errorf("GetHash of shadowing file = %q, %d", hash, errc)
+	}
+	if hash, errc := o.GetHash("/h"); errc != 0 || hash != "hash:a/f" {
+		t.Errorf("GetHash of lower file = %q, %d", hash, errc)
+	}
+}
+
+func TestBuildMarkers(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, ".wh.cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{".wh.cache/x", ".wh.f"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	toValue := func(path string) string { return "" }
+	tree := &Tree{}
+	if err := tree.Build(root, toValue); err != nil {
+		t.Fatal(err)
+	}
+	var stat syscall.Stat_t
+	if tree.Stat("/.wh.cache/x", &stat) != nil || tree.Stat("/.wh.f", &stat) != nil {
+		t.Errorf("files named as markers not kept outside layers")
+	}
+	if err := tree.BuildWith(root, BuildOptions{Layer: true}, toValue); err == nil {
+		t.Errorf("BuildWith accepted a directory named as a whiteout")
+	}
+}
+
+func TestBuildPrev(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{"f", "g"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var hashed []string
+	toValue := func(path string) string {
+		hashed = append(hashed, path)
+		return "hash:" + path
+	}
+	prev := &Tree{}
+	if err := prev.Build(root, toValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "g"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashed = nil
+	var reused []string
+	opts := BuildOptions{Prev: prev, Reused: func(path, value string) {
+		reused = append(reused, path+" "+value)
+	}}
+	tree := &Tree{}
+	if err := tree.BuildWith(root, opts, toValue); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashed) != 1 || hashed[0] != "g" {
+		t.Errorf("BuildWith hashed %v, want [g]", hashed)
+	}
+	if len(reused) != 1 || reused[0] != "f hash:f" {
+		t.Errorf("BuildWith reused %v, want [f hash:f]", reused)
+	}
+	if hash, _ := tree.GetHash("/f"); hash != "hash:f" {
+		t.Errorf("GetHash of reused file = %q", hash)
+	}
+
+	hashed = nil
+	if err := tree.Rebuild(root, prev, toValue); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashed) != 1 || hashed[0] != "g" {
+		t.Errorf("Rebuild hashed %v, want [g]", hashed)
+	}
+}
+
+func TestBuildJobs(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 100; i++ {
+		dir := filepath.Join(root, string(rune('a'+i%10)))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, string(rune('a'+i/10))), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	toValue := func(path string) string { return "hash:" + path }
+	serial, parallel := &Tree{}, &Tree{}
+	if err := serial.Build(root, toValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := parallel.BuildWith(root, BuildOptions{Jobs: 8}, toValue); err != nil {
+		t.Fatal(err)
+	}
+	for i := range serial.nodes {
+		// walking the first time may update directory access times
+		serial.nodes[i].Atime, parallel.nodes[i].Atime = 0, 0
+	}
+	a, _ := serial.Encode()
+	b, _ := parallel.Encode()
+	if string(a) != string(b) {
+		t.Errorf("parallel build differs from serial build")
+	}
+}
+
+func TestSign(t *testing.T) {
+	tree := buildTestTree(t)
+	file := filepath.Join(t.TempDir(), "meta")
+	if err := tree.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+
+	restored := &Tree{}
+	if err := restored.RestoreSigned(file, []ed25519.PublicKey{pub}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("RestoreSigned of unsigned metadata: %v", err)
+	}
+	if err := SignFile(file, priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreSigned(file, []ed25519.PublicKey{other}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("RestoreSigned with untrusted key: %v", err)
+	}
+	if err := restored.RestoreSigned(file, []ed25519.PublicKey{other, pub}); err != nil {
+		t.Errorf("RestoreSigned: %v", err)
+	}
+
+	// rewriting the file in place must not change the verified tree
+	data, _ := os.ReadFile(file)
+	data[len(data)-1] ^= 1
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, len(data)-headerSize), headerSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	checkTestTree(t, restored)
+	restored.Close()
+
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreSigned(file, []ed25519.PublicKey{pub}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("RestoreSigned of tampered metadata: %v", err)
+	}
+}
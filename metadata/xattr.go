@@ -0,0 +1,96 @@
+package metadata
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of the file at path,
+// or nil if it has none.
+func readXattrs(path string) map[string][]byte {
+	buf, err := getBuf(func(b []byte) (int, error) {
+		return syscall.Listxattr(path, b)
+	})
+	if err != nil {
+		if err != syscall.ENOTSUP {
+			log.Printf("[WARN] %q: listxattr: %v", path, err)
+		}
+		return nil
+	}
+	var xattrs map[string][]byte
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getBuf(func(b []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), b)
+		})
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			log.Printf("[WARN] %q: getxattr %s: %v", path, name, err)
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs
+}
+
+// getBuf calls get with a buffer large enough for its result,
+// which may grow between calls.
+func getBuf(get func(b []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// GetXattr returns the value of extended attribute name of path.
+func (t *Tree) GetXattr(path string, name string) (value []byte, errc int) {
+	return t.lookup(path).getXattr(name)
+}
+
+// ListXattr returns the sorted names of extended attributes of path.
+func (t *Tree) ListXattr(path string) (names []string, errc int) {
+	return t.lookup(path).listXattr()
+}
+
+func (n *Node) getXattr(name string) (value []byte, errc int) {
+	if n == nil {
+		errc = -int(syscall.ENOENT)
+		return
+	}
+	value, ok := n.Xattrs[name]
+	if !ok {
+		errc = -int(syscall.ENODATA)
+	}
+	return
+}
+
+func (n *Node) listXattr() (names []string, errc int) {
+	if n == nil {
+		errc = -int(syscall.ENOENT)
+		return
+	}
+	for name := range n.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,111 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kaijchen/cafs/config"
+	"github.com/kaijchen/cafs/layout"
+)
+
+// migrate moves the objects in the pool and zpool in place from another
+// layout to l. It should not run while the pools are in use. Read-only
+// pools are not moved, as they keep their own layouts.
+func migrate(cfg config.Config, l layout.Layout, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		dryRun = flags.Bool("n", false, "only report what would be moved")
+		from   = flags.String("from", "flat", "current layout of the pools")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v migrate [options]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Moves the objects in the pools to the configured layout %v.\n", l)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	old, err := layout.Parse(*from)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	var moved int
+	for _, p := range []struct{ dir, suffix string }{{cfg.Pool, ""}, {cfg.Zpool, zstSuffix}} {
+		if p.dir == "" {
+			continue
+		}
+		n, err := relayout(p.dir, p.suffix, old, l, *dryRun)
+		moved += n
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	verb := "moved"
+	if *dryRun {
+		verb = "would move"
+	}
+	log.Printf("[INFO] %s %d objects from layout %v to %v", verb, moved, old, l)
+	for i, dir := range cfg.ReadOnlyPools() {
+		if cfg.ReadOnlyLayout(i) == cfg.PoolLayout && old.String() != l.String() {
+			log.Printf("[WARN] read-only pool %s was left alone, set its read_only_layouts entry "+
+				"to %v unless it is in layout %v already", dir, old, l)
+		}
+	}
+}
+
+// relayout moves the files named <hash><suffix> in dir from layout
+// from to layout to, removing the directories left empty. It returns
+// the number of files moved.
+func relayout(dir, suffix string, from, to layout.Layout, dryRun bool) (int, error) {
+	// collect first, as moving may add to the directories being walked
+	var paths []string
+	err := from.Walk(dir, func(path string, d fs.DirEntry) error {
+		if hash := strings.TrimSuffix(d.Name(), suffix); validHash(hash) && d.Name() == hash+suffix {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, path := range paths {
+		name := filepath.Base(path)
+		newPath := to.Path(dir, name)
+		if newPath == path {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%s -> %s\n", path, newPath)
+			moved++
+			continue
+		}
+		if err := to.Create(dir, name); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(path, newPath); err != nil {
+			return moved, err
+		}
+		moved++
+		// remove the parents left empty, stopping at the first that is not
+		for d := filepath.Dir(path); d != dir && os.Remove(d) == nil; d = filepath.Dir(d) {
+		}
+	}
+	return moved, nil
+}
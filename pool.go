@@ -0,0 +1,202 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/kaijchen/cafs/layout"
+)
+
+// poolCache keeps the pool within capacity bytes, evicting the least
+// recently used objects that are not open. A nil *poolCache does nothing.
+//
+// The tracker protocol cannot withdraw an object, so peers still sent
+// here for an evicted object get a 404 and fall back to the remotes.
+type poolCache struct {
+	dir      string
+	layout   layout.Layout
+	capacity int64
+
+	mu      sync.Mutex
+	used    int64
+	lru     *list.List // of *poolObject, most recently used first
+	objects map[string]*list.Element
+	handles map[uint64]string // hashes of open file handles
+}
+
+type poolObject struct {
+	hash string
+	size int64
+	pins int // open handles and opens in progress
+}
+
+// newPoolCache scans the objects in dir, ordering them by access time.
+func newPoolCache(dir string, l layout.Layout, capacity int64) (*poolCache, error) {
+	c := &poolCache{
+		dir:      dir,
+		layout:   l,
+		capacity: capacity,
+		lru:      list.New(),
+		objects:  make(map[string]*list.Element),
+		handles:  make(map[uint64]string),
+	}
+	type scanned struct {
+		hash  string
+		size  int64
+		atime int64
+	}
+	var objects []scanned
+	err := l.Walk(dir, func(path string, d fs.DirEntry) error {
+		if !validHash(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		atime := info.Sys().(*syscall.Stat_t).Atim.Nano()
+		objects = append(objects, scanned{d.Name(), info.Size(), atime})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].atime > objects[j].atime
+	})
+	for _, o := range objects {
+		c.objects[o.hash] = c.lru.PushBack(&poolObject{hash: o.hash, size: o.size})
+		c.used += o.size
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *poolCache) path(hash string) string {
+	return c.layout.Path(c.dir, hash)
+}
+
+// pin marks object hash as in use, so it is not evicted while being
+// fetched or opened. Each pin is undone by unpin or by release of the
+// handle passed to opened.
+func (c *poolCache) pin(hash string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.objects[hash]
+	if !ok {
+		// put into the pool behind our back, or yet to be added
+		o := &poolObject{hash: hash}
+		if info, err := os.Stat(c.path(hash)); err == nil {
+			o.size = info.Size()
+			c.used += o.size
+		}
+		e = c.lru.PushFront(o)
+		c.objects[hash] = e
+	}
+	e.Value.(*poolObject).pins++
+	c.lru.MoveToFront(e)
+}
+
+func (c *poolCache) unpin(hash string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unpinLocked(hash)
+}
+
+func (c *poolCache) unpinLocked(hash string) {
+	e, ok := c.objects[hash]
+	if !ok {
+		return
+	}
+	o := e.Value.(*poolObject)
+	if o.pins--; o.pins == 0 {
+		if o.size == 0 {
+			// never added, or empty
+			if _, err := os.Stat(c.path(hash)); err != nil {
+				c.lru.Remove(e)
+				delete(c.objects, hash)
+				return
+			}
+		}
+		c.evict()
+	}
+}
+
+// opened records that the pinned object hash is open as fh.
+func (c *poolCache) opened(hash string, fh uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.handles[fh] = hash
+	c.mu.Unlock()
+}
+
+// release unpins the object open as fh.
+func (c *poolCache) release(fh uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hash, ok := c.handles[fh]; ok {
+		delete(c.handles, fh)
+		c.unpinLocked(hash)
+	}
+}
+
+// add counts the object hash, just put into the pool, in its usage.
+func (c *poolCache) add(hash string, size int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.objects[hash]
+	if !ok {
+		e = c.lru.PushFront(&poolObject{hash: hash})
+		c.objects[hash] = e
+	}
+	o := e.Value.(*poolObject)
+	c.used += size - o.size
+	o.size = size
+	c.evict()
+}
+
+// evict removes the least recently used objects not in use until the
+// pool fits its capacity.
+func (c *poolCache) evict() {
+	for e := c.lru.Back(); e != nil && c.used > c.capacity; {
+		prev := e.Prev()
+		o := e.Value.(*poolObject)
+		if o.pins == 0 {
+			err := os.Remove(c.path(o.hash))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("[WARN] evict %s: %v", o.hash, err)
+			} else {
+				c.used -= o.size
+				c.lru.Remove(e)
+				delete(c.objects, o.hash)
+			}
+		}
+		e = prev
+	}
+}
@@ -0,0 +1,123 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kaijchen/cafs/layout"
+)
+
+// putObjects writes objects of size bytes into the flat pool dir, the
+// first being the least recently used, and returns their hashes.
+func putObjects(t *testing.T, dir string, n int, size int64) []string {
+	var hashes []string
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		data := []byte(fmt.Sprintf("%0*d", size, i))
+		hash := testHash(data)
+		path := layout.Layout{}.Path(dir, hash)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		atime := now.Add(time.Duration(i-n) * time.Minute)
+		if err := os.Chtimes(path, atime, atime); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func inPool(c *poolCache, hash string) bool {
+	_, err := os.Stat(c.path(hash))
+	return err == nil
+}
+
+func TestPoolCapacity(t *testing.T) {
+	dir := t.TempDir()
+	hashes := putObjects(t, dir, 4, 10)
+	c, err := newPoolCache(dir, layout.Layout{}, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the two least recently used are evicted on startup
+	for i, hash := range hashes {
+		if want := i >= 2; inPool(c, hash) != want {
+			t.Errorf("object %d in pool: %v, want %v", i, !want, want)
+		}
+	}
+	if c.used != 20 {
+		t.Errorf("used %d, want 20", c.used)
+	}
+
+	// opening an object makes it the most recently used
+	c.pin(hashes[2])
+	c.unpin(hashes[2])
+	data := []byte("0123456789")
+	extra := testHash(data)
+	if err := os.WriteFile(c.path(extra), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.add(extra, 10)
+	if !inPool(c, hashes[2]) || inPool(c, hashes[3]) || !inPool(c, extra) {
+		t.Errorf("least recently used object not evicted")
+	}
+	if c.used > c.capacity {
+		t.Errorf("used %d beyond capacity %d", c.used, c.capacity)
+	}
+}
+
+func TestPoolPinned(t *testing.T) {
+	dir := t.TempDir()
+	hashes := putObjects(t, dir, 3, 10)
+	c, err := newPoolCache(dir, layout.Layout{}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pin(hashes[0])
+	c.opened(hashes[0], 1)
+	c.pin(hashes[1])
+
+	c.capacity = 0
+	c.evict()
+	if !inPool(c, hashes[0]) || !inPool(c, hashes[1]) || inPool(c, hashes[2]) {
+		t.Fatalf("pinned objects evicted, or unpinned ones kept")
+	}
+	c.unpin(hashes[1])
+	if inPool(c, hashes[1]) {
+		t.Errorf("unpinned object kept beyond capacity")
+	}
+	c.release(1)
+	if inPool(c, hashes[0]) {
+		t.Errorf("released object kept beyond capacity")
+	}
+	if c.used != 0 || c.lru.Len() != 0 {
+		t.Errorf("used %d by %d objects, want none", c.used, c.lru.Len())
+	}
+}
+
+func TestPoolMissing(t *testing.T) {
+	c, err := newPoolCache(t.TempDir(), layout.Layout{}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pinned for a fetch that failed
+	hash := testHash([]byte("missing"))
+	c.pin(hash)
+	c.pin(hash)
+	c.unpin(hash)
+	if _, ok := c.objects[hash]; !ok {
+		t.Fatalf("entry of pinned object removed")
+	}
+	c.unpin(hash)
+	if _, ok := c.objects[hash]; ok || c.lru.Len() != 0 {
+		t.Errorf("entry of missing object kept")
+	}
+	// unpinning it again is harmless
+	c.unpin(hash)
+}
@@ -0,0 +1,111 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kaijchen/cafs/layout"
+	"github.com/kaijchen/cafs/location"
+)
+
+// objectServer serves the objects of a pool to peers, at /<hash>,
+// and their compressed form in the zpool, if any, at /<hash>.zst.
+// URLs are the same whatever the layout of the pools.
+type objectServer struct {
+	pool   string
+	zpool  string
+	layout layout.Layout
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Path[1:]
+	hash, path := name, s.layout.Path(s.pool, name)
+	if strings.HasSuffix(name, zstSuffix) && s.zpool != "" {
+		hash, path = strings.TrimSuffix(name, zstSuffix), s.layout.Path(s.zpool, name)
+	}
+	// this also refuses tmp_ files still being written
+	if !validHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	// ServeContent handles Range requests
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// validHash reports whether s is a hex encoded sha256 hash.
+func validHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// listen starts serving the pool on port, reporting its objects to
+// the tracker if loc is not nil. It returns once listening.
+func listen(pool, zpool string, l layout.Layout, port int, loc *location.Loc) (*http.Server, error) {
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: &objectServer{pool: pool, zpool: zpool, layout: l}}
+	go func() {
+		if err := srv.Serve(lis); err != http.ErrServerClosed {
+			log.Printf("[ERROR] object server: %v", err)
+		}
+	}()
+	if loc != nil {
+		go reportPool(pool, l, loc)
+	}
+	return srv, nil
+}
+
+// reportPool reports all objects in the pool to the tracker.
+func reportPool(pool string, l layout.Layout, loc *location.Loc) {
+	var hashes []string
+	err := l.Walk(pool, func(path string, d fs.DirEntry) error {
+		if validHash(d.Name()) {
+			hashes = append(hashes, d.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] report pool: %v", err)
+		return
+	}
+	if err := loc.ReportBatch(hashes); err != nil {
+		log.Printf("[ERROR] report pool: %v", err)
+	}
+	log.Printf("[INFO] reported %d objects to the tracker", len(hashes))
+}
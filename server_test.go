@@ -0,0 +1,108 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaijchen/cafs/layout"
+)
+
+// putObject writes data into dir as name under layout l.
+func putObject(t *testing.T, l layout.Layout, dir, name string, data []byte) {
+	if err := l.Create(dir, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(l.Path(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// httpGet requests path from srv, with a Range header if rng is not empty.
+func httpGet(t *testing.T, srv *httptest.Server, path, rng string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestObjectServer(t *testing.T) {
+	hash := testHash(testObject)
+	compressed := "compressed form"
+	for _, lay := range []string{"flat", "2/2"} {
+		l, err := layout.Parse(lay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool, zpool := t.TempDir(), t.TempDir()
+		putObject(t, l, pool, hash, testObject)
+		putObject(t, l, zpool, hash+zstSuffix, []byte(compressed))
+		putObject(t, l, pool, "tmp_123", testObject)
+		if err := os.WriteFile(filepath.Join(pool, "notes"), testObject, 0644); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(&objectServer{pool: pool, zpool: zpool, layout: l})
+
+		tests := []struct {
+			path   string
+			rng    string
+			status int
+			body   string
+		}{
+			{"/" + hash, "", http.StatusOK, string(testObject)},
+			{"/" + hash + zstSuffix, "", http.StatusOK, compressed},
+			{"/" + hash, "bytes=7-11", http.StatusPartialContent, "world"},
+			// partial objects and other files are not objects
+			{"/tmp_123", "", http.StatusNotFound, ""},
+			{"/notes", "", http.StatusNotFound, ""},
+			{"/" + testHash([]byte("missing")), "", http.StatusNotFound, ""},
+		}
+		for _, tt := range tests {
+			status, body := httpGet(t, srv, tt.path, tt.rng)
+			if status != tt.status || tt.status != http.StatusNotFound && body != tt.body {
+				t.Errorf("%s: GET %s (%s) = %d %q, want %d %q",
+					lay, tt.path, tt.rng, status, body, tt.status, tt.body)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestObjectServerNoZpool(t *testing.T) {
+	hash := testHash(testObject)
+	pool := t.TempDir()
+	putObject(t, layout.Layout{}, pool, hash, testObject)
+	srv := httptest.NewServer(&objectServer{pool: pool})
+	defer srv.Close()
+	// peers fall back to the object itself
+	if status, _ := httpGet(t, srv, "/"+hash+zstSuffix, ""); status != http.StatusNotFound {
+		t.Errorf("GET of compressed object without zpool = %d, want 404", status)
+	}
+	resp, err := srv.Client().Post(srv.URL+"/"+hash, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", resp.StatusCode)
+	}
+}
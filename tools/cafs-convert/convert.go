@@ -3,15 +3,18 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 
 	"github.com/kaijchen/cafs/config"
+	"github.com/kaijchen/cafs/layout"
 	"github.com/kaijchen/cafs/metadata"
+	"github.com/klauspost/compress/zstd"
 )
 
 func sha256sum(path string) (checksum string) {
@@ -28,42 +31,154 @@ func sha256sum(path string) (checksum string) {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func stashTo(pool string, zpool string) func(path string) string {
+func stashTo(pool string, zpool string, l layout.Layout) func(path string) string {
 	if pool == "" {
 		return sha256sum
 	}
+	store := stash(pool, zpool, l)
 	return func(path string) (checksum string) {
 		checksum = sha256sum(path)
-		caspath := filepath.Join(pool, checksum)
+		store(path, checksum)
+		return
+	}
+}
+
+// stash returns a function putting the file at path into the pool and
+// zpool, unless already there, as object checksum.
+func stash(pool string, zpool string, l layout.Layout) func(path, checksum string) {
+	return func(path, checksum string) {
+		caspath := l.Path(pool, checksum)
 		if _, err := os.Stat(caspath); os.IsNotExist(err) {
-			os.Link(path, filepath.Join(pool, checksum))
+			if err := l.Create(pool, checksum); err != nil {
+				log.Printf("[WARN] %q: %v", path, err)
+			}
+			os.Link(path, caspath)
+		}
+		if zpool == "" {
+			return
 		}
-		zpath := filepath.Join(zpool, checksum+".zst")
+		zname := checksum + ".zst"
+		zpath := l.Path(zpool, zname)
 		if _, err := os.Stat(zpath); os.IsNotExist(err) {
-			exec.Command("zstd", "-o", zpath, path).Run()
+			if err := l.Create(zpool, zname); err != nil {
+				log.Printf("[WARN] %q: %v", path, err)
+			}
+			if err := compress(path, zpool, zpath); err != nil {
+				log.Printf("[WARN] %q: %v", path, err)
+			}
 		}
-		return
 	}
 }
 
+// compress writes the file at path zstd compressed to zpath, through
+// a temporary file in zpool, so that zpath never holds a partial object.
+func compress(path, zpool, zpath string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(zpool, "tmp_"+filepath.Base(zpath)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// files are already compressed concurrently, see -j
+	enc, err := zstd.NewWriter(tmp, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		enc.Close()
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), zpath)
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Printf("Usage: %v root meta [pool]\n", os.Args[0])
+	var (
+		format = flag.String("format", "binary", "metadata format (binary or json)")
+		prev   = flag.String("prev", "", "previous metadata of root, to reuse hashes of unchanged files")
+		jobs   = flag.Int("j", runtime.NumCPU(), "number of files to hash and stash concurrently")
+		sign   = flag.String("sign", "", "private key file to sign the metadata with")
+		lay    = flag.String("layout", "", "layout of the pools, such as 2/2 (default from config, or flat)")
+		layer  = flag.Bool("layer", false, "record .wh.* files in root as whiteouts and opaque markers")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [options] root meta [pool]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
 		os.Exit(-1)
 	}
-	root, meta := os.Args[1], os.Args[2]
+	mf, err := metadata.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	root, meta := args[0], args[1]
 	var pool, zpool string
-	if len(os.Args) < 4 {
-		if cfg, err := config.GetDefaultConfig(); err == nil {
+	cfg, cfgErr := config.GetDefaultConfig()
+	if len(args) < 3 {
+		if cfgErr == nil {
 			pool = cfg.Pool
 			zpool = cfg.Zpool
 		}
 	} else {
-		pool = os.Args[3]
+		pool = args[2]
+	}
+	if *lay == "" && cfgErr == nil {
+		*lay = cfg.PoolLayout
+	}
+	poolLayout, err := layout.Parse(*lay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var prevTree *metadata.Tree
+	if *prev != "" {
+		prevTree = &metadata.Tree{}
+		if err := prevTree.Restore(*prev); err != nil {
+			log.Fatal(err)
+		}
+		defer prevTree.Close()
 	}
 	tree := metadata.Tree{}
-	if err := tree.Build(root, stashTo(pool, zpool)); err != nil {
-		fmt.Println(err)
+	opts := metadata.BuildOptions{Prev: prevTree, Jobs: *jobs, Layer: *layer}
+	if pool != "" {
+		// the objects of reused hashes may be gone, or in another pool
+		opts.Reused = stash(pool, zpool, poolLayout)
+	}
+	if err := tree.BuildWith(root, opts, stashTo(pool, zpool, poolLayout)); err != nil {
+		// never save, let alone sign, a partial tree
+		log.Fatal(err)
+	}
+	if err := tree.SaveAs(meta, mf); err != nil {
+		log.Fatal(err)
+	}
+	if *sign != "" {
+		key, err := metadata.ReadPrivateKey(*sign)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := metadata.SignFile(meta, key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	hash, err := tree.RootHash()
+	if err != nil {
+		log.Fatal(err)
 	}
-	tree.Save(meta)
+	fmt.Println(hash)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kaijchen/cafs/metadata"
+)
+
+var kindLetters = map[metadata.ChangeKind]string{
+	metadata.Added:       "A",
+	metadata.Removed:     "D",
+	metadata.Modified:    "M",
+	metadata.TypeChanged: "T",
+}
+
+func main() {
+	var (
+		useJSON = flag.Bool("json", false, "print changes as JSON")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [options] old-meta new-meta\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Exits with status 1 if the trees differ.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var a, b metadata.Tree
+	if err := a.Restore(args[0]); err != nil {
+		log.Fatal(err)
+	}
+	defer a.Close()
+	if err := b.Restore(args[1]); err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	changes, err := metadata.Diff(&a, &b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *useJSON {
+		if changes == nil {
+			changes = []metadata.Change{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(changes); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, c := range changes {
+			fmt.Printf("%s %s\n", kindLetters[c.Kind], c.Path)
+		}
+	}
+	if len(changes) > 0 {
+		a.Close()
+		b.Close()
+		os.Exit(1)
+	}
+}
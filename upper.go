@@ -0,0 +1,607 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+// Copyright 2021 Kaijie Chen. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/kaijchen/cafs/metadata"
+)
+
+// The upper directory holds what was written to the mount, as in an
+// OCI layer: files and directories shadow those of the metadata, which
+// are copied up on first write, and deletions are recorded as whiteouts,
+// so that Tree.BuildWith of the upper directory with Layer set, as by
+// cafs-convert -layer, makes a layer to mount above.
+
+// upperPath returns where path is in the upper directory.
+func (cafs *Cafs) upperPath(path string) string {
+	return filepath.Join(cafs.upper, path)
+}
+
+// whiteoutPath returns where the whiteout of path is in the upper directory.
+func (cafs *Cafs) whiteoutPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(cafs.upper, dir, metadata.WhiteoutPrefix+name)
+}
+
+func exists(path string) bool {
+	stat := syscall.Stat_t{}
+	return syscall.Lstat(path, &stat) == nil
+}
+
+// reserved reports whether the name of path is one of the markers
+// of the upper directory, which cannot be made through the mount.
+func reserved(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), metadata.WhiteoutPrefix)
+}
+
+// masked reports whether path has a name reserved for the markers on
+// the way, so that it cannot be reached through a mount with an upper
+// directory. Files of the metadata named alike are masked as well, as
+// they could not be removed.
+func (cafs *Cafs) masked(path string) bool {
+	if cafs.upper == "" {
+		return false
+	}
+	for _, name := range strings.Split(path, "/") {
+		if strings.HasPrefix(name, metadata.WhiteoutPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sysErr unwraps err to its syscall.Errno, so that errno can take it.
+func sysErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	return syscall.EIO
+}
+
+// hidden reports whether path in the metadata is hidden by the upper
+// directory, by a whiteout, an opaque directory or a non-directory on
+// the way.
+func (cafs *Cafs) hidden(path string) bool {
+	for p := path; p != "/"; p = filepath.Dir(p) {
+		stat := syscall.Stat_t{}
+		if p != path && syscall.Lstat(cafs.upperPath(p), &stat) == nil &&
+			stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return true
+		}
+		if exists(cafs.whiteoutPath(p)) ||
+			exists(filepath.Join(cafs.upperPath(filepath.Dir(p)), metadata.OpaqueMarker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inLower reports whether path is in the metadata and not hidden.
+func (cafs *Cafs) inLower(path string) bool {
+	stat := syscall.Stat_t{}
+	return cafs.Stat(path, &stat) == nil && (cafs.upper == "" || !cafs.masked(path) && !cafs.hidden(path))
+}
+
+// stat gets the attributes of path, from the upper directory if there.
+func (cafs *Cafs) stat(path string, stat *syscall.Stat_t) error {
+	if cafs.upper != "" {
+		if cafs.masked(path) {
+			return syscall.ENOENT
+		}
+		if err := syscall.Lstat(cafs.upperPath(path), stat); err == nil {
+			return nil
+		}
+		if cafs.hidden(path) {
+			return syscall.ENOENT
+		}
+	}
+	return cafs.Stat(path, stat)
+}
+
+// names returns the names in directory path, merging those in the
+// upper directory.
+func (cafs *Cafs) names(path string) []string {
+	if cafs.upper == "" {
+		return cafs.ListDir(path)
+	}
+	names := []string{".", ".."}
+	seen := map[string]bool{".": true, "..": true}
+	opaque := false
+	// fails if only in the metadata
+	entries, _ := os.ReadDir(cafs.upperPath(path))
+	for _, e := range entries {
+		name := e.Name()
+		if name == metadata.OpaqueMarker {
+			opaque = true
+		} else if strings.HasPrefix(name, metadata.WhiteoutPrefix) {
+			seen[strings.TrimPrefix(name, metadata.WhiteoutPrefix)] = true
+		} else {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if !opaque && !cafs.hidden(path) {
+		for _, name := range cafs.ListDir(path) {
+			if !seen[name] && !reserved(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// copyUp copies path from the metadata to the upper directory along
+// with its parents, unless already there. Hard links are broken.
+func (cafs *Cafs) copyUp(path string) error {
+	if exists(cafs.upperPath(path)) {
+		return nil
+	}
+	if path == "/" {
+		// the upper directory is gone
+		return syscall.ENOENT
+	}
+	if err := cafs.copyUp(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return cafs.flights.do("copyup:"+path, func() error {
+		if exists(cafs.upperPath(path)) {
+			// copied by a flight that just landed
+			return nil
+		}
+		stat := syscall.Stat_t{}
+		if cafs.hidden(path) || cafs.Stat(path, &stat) != nil {
+			return syscall.ENOENT
+		}
+		upath := cafs.upperPath(path)
+		var err error
+		switch stat.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			err = syscall.Mkdir(upath, 0700)
+		case syscall.S_IFLNK:
+			target, errc := cafs.GetLink(path)
+			if errc != 0 {
+				return syscall.Errno(-errc)
+			}
+			return sysErr(os.Symlink(target, upath))
+		case syscall.S_IFREG:
+			err = cafs.copyUpFile(path, upath)
+		default:
+			err = syscall.Mknod(upath, stat.Mode, int(stat.Rdev))
+		}
+		if err != nil {
+			return sysErr(err)
+		}
+		// ownership is only kept when permitted, as when mounted by root
+		syscall.Chown(upath, int(stat.Uid), int(stat.Gid))
+		// after chown, which drops capabilities, and before chmod, which
+		// may take away the write permission user.* xattrs need
+		cafs.copyXattrs(path, upath)
+		if err := syscall.Chmod(upath, stat.Mode&07777); err != nil {
+			return err
+		}
+		return syscall.UtimesNano(upath, []syscall.Timespec{
+			syscall.NsecToTimespec(stat.Atim.Nano()),
+			syscall.NsecToTimespec(stat.Mtim.Nano()),
+		})
+	})
+}
+
+// copyXattrs copies the xattrs of path in the metadata to upath. Those
+// not permitted, such as security.* unless mounted by root, are left
+// out with a warning.
+func (cafs *Cafs) copyXattrs(path, upath string) {
+	names, _ := cafs.ListXattr(path)
+	for _, name := range names {
+		value, errc := cafs.GetXattr(path, name)
+		if errc != 0 {
+			continue
+		}
+		if err := syscall.Setxattr(upath, name, value, 0); err != nil {
+			log.Printf("[WARN] %s: copy up xattr %s: %v", path, name, err)
+		}
+	}
+}
+
+// copyUpFile copies regular file path from the pool to upath.
+func (cafs *Cafs) copyUpFile(path, upath string) error {
+	errc, fh := cafs.open(path, syscall.O_RDONLY, 0)
+	if errc != 0 {
+		return syscall.Errno(-errc)
+	}
+	src := os.NewFile(uintptr(fh), path)
+	defer func() {
+		cafs.cache.release(fh)
+		src.Close()
+	}()
+	// named as a whiteout, so that it is hidden until renamed into place,
+	// and harmless if left behind
+	tmp, err := os.CreateTemp(filepath.Dir(upath), metadata.WhiteoutPrefix+"tmp_")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), upath); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// whiteout hides path in the metadata.
+func (cafs *Cafs) whiteout(path string) error {
+	if err := cafs.copyUp(filepath.Dir(path)); err != nil {
+		return err
+	}
+	fd, err := syscall.Open(cafs.whiteoutPath(path), syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// prepare makes way for creating path in the upper directory.
+func (cafs *Cafs) prepare(path string) error {
+	if cafs.upper == "" {
+		return syscall.EROFS
+	}
+	if reserved(path) {
+		return syscall.EINVAL
+	}
+	if cafs.masked(path) {
+		return syscall.ENOENT
+	}
+	return cafs.copyUp(filepath.Dir(path))
+}
+
+// created finishes creating path in the upper directory, uncovering
+// its whiteout, if any. A directory replacing one in the metadata is
+// made opaque, so that it starts empty.
+func (cafs *Cafs) created(path string) error {
+	err := syscall.Unlink(cafs.whiteoutPath(path))
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+	upath := cafs.upperPath(path)
+	stat := syscall.Stat_t{}
+	if syscall.Lstat(upath, &stat) == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFDIR &&
+		cafs.Stat(path, &stat) == nil {
+		fd, err := syscall.Open(filepath.Join(upath, metadata.OpaqueMarker), syscall.O_WRONLY|syscall.O_CREAT, 0644)
+		if err != nil {
+			return err
+		}
+		return syscall.Close(fd)
+	}
+	return nil
+}
+
+// Create creates and opens a file.
+func (cafs *Cafs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	if err := cafs.prepare(path); err != nil {
+		return errno(err), ^uint64(0)
+	}
+	f, e := syscall.Open(cafs.upperPath(path), flags|syscall.O_CREAT, mode)
+	if e != nil {
+		return errno(e), ^uint64(0)
+	}
+	if err := cafs.created(path); err != nil {
+		syscall.Close(f)
+		return errno(err), ^uint64(0)
+	}
+	return 0, uint64(f)
+}
+
+// Mkdir creates a directory.
+func (cafs *Cafs) Mkdir(path string, mode uint32) (errc int) {
+	if err := cafs.prepare(path); err != nil {
+		return errno(err)
+	}
+	if err := syscall.Mkdir(cafs.upperPath(path), mode); err != nil {
+		return errno(err)
+	}
+	return errno(cafs.created(path))
+}
+
+// Symlink creates a symbolic link.
+func (cafs *Cafs) Symlink(target string, newpath string) (errc int) {
+	if err := cafs.prepare(newpath); err != nil {
+		return errno(err)
+	}
+	if err := syscall.Symlink(target, cafs.upperPath(newpath)); err != nil {
+		return errno(err)
+	}
+	return errno(cafs.created(newpath))
+}
+
+// Link creates a hard link to a file.
+func (cafs *Cafs) Link(oldpath string, newpath string) (errc int) {
+	if err := cafs.prepare(newpath); err != nil {
+		return errno(err)
+	}
+	if cafs.masked(oldpath) {
+		return -fuse.ENOENT
+	}
+	if err := cafs.copyUp(oldpath); err != nil {
+		return errno(err)
+	}
+	if err := syscall.Link(cafs.upperPath(oldpath), cafs.upperPath(newpath)); err != nil {
+		return errno(err)
+	}
+	return errno(cafs.created(newpath))
+}
+
+// Unlink removes a file.
+func (cafs *Cafs) Unlink(path string) (errc int) {
+	return cafs.remove(path, syscall.Unlink)
+}
+
+// Rmdir removes a directory.
+func (cafs *Cafs) Rmdir(path string) (errc int) {
+	if cafs.upper != "" && len(cafs.names(path)) > 2 {
+		return -fuse.ENOTEMPTY
+	}
+	return cafs.remove(path, rmdir)
+}
+
+// rmdir removes directory upath, empty through the mount, so what is
+// left in it are markers. Only those are removed before the directory,
+// so that anything created meanwhile makes it fail with ENOTEMPTY
+// rather than be lost, and the markers are then put back.
+func rmdir(upath string) error {
+	entries, err := os.ReadDir(upath)
+	if err != nil {
+		return sysErr(err)
+	}
+	var removed []string
+	for _, e := range entries {
+		if !reserved(e.Name()) || !e.Type().IsRegular() {
+			continue
+		}
+		marker := filepath.Join(upath, e.Name())
+		if err := syscall.Unlink(marker); err == nil {
+			removed = append(removed, marker)
+		} else if err != syscall.ENOENT {
+			return err
+		}
+	}
+	err = syscall.Rmdir(upath)
+	if err != nil {
+		for _, marker := range removed {
+			if fd, err := syscall.Open(marker, syscall.O_WRONLY|syscall.O_CREAT, 0644); err == nil {
+				syscall.Close(fd)
+			}
+		}
+	}
+	return err
+}
+
+// remove removes path from the upper directory with rm, and hides it
+// in the metadata.
+func (cafs *Cafs) remove(path string, rm func(upath string) error) (errc int) {
+	if cafs.upper == "" {
+		return -fuse.EROFS
+	}
+	if cafs.masked(path) {
+		return -fuse.ENOENT
+	}
+	upath := cafs.upperPath(path)
+	inUpper, inLower := exists(upath), cafs.inLower(path)
+	if !inUpper && !inLower {
+		return -fuse.ENOENT
+	}
+	if inUpper {
+		if err := rm(upath); err != nil {
+			return errno(err)
+		}
+	}
+	if inLower {
+		return errno(cafs.whiteout(path))
+	}
+	return 0
+}
+
+// Rename renames a file. Directories in the metadata are not renamed
+// but fail with EXDEV, for the caller to copy them instead, as overlayfs
+// does.
+func (cafs *Cafs) Rename(oldpath string, newpath string) (errc int) {
+	if err := cafs.prepare(newpath); err != nil {
+		return errno(err)
+	}
+	stat := syscall.Stat_t{}
+	if cafs.stat(oldpath, &stat) != nil {
+		return -fuse.ENOENT
+	}
+	oldLower := cafs.inLower(oldpath)
+	if stat.Mode&syscall.S_IFMT == syscall.S_IFDIR && oldLower {
+		return -fuse.EXDEV
+	}
+	if cafs.inLower(newpath) && cafs.Stat(newpath, &stat) == nil &&
+		stat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return -fuse.EXDEV
+	}
+	if err := cafs.copyUp(oldpath); err != nil {
+		return errno(err)
+	}
+	if err := syscall.Rename(cafs.upperPath(oldpath), cafs.upperPath(newpath)); err != nil {
+		return errno(err)
+	}
+	if err := cafs.created(newpath); err != nil {
+		return errno(err)
+	}
+	if oldLower {
+		return errno(cafs.whiteout(oldpath))
+	}
+	return 0
+}
+
+// Chmod changes the permission bits of a file.
+func (cafs *Cafs) Chmod(path string, mode uint32) (errc int) {
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	return errno(syscall.Chmod(cafs.upperPath(path), mode))
+}
+
+// Chown changes the owner and group of a file.
+func (cafs *Cafs) Chown(path string, uid uint32, gid uint32) (errc int) {
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	return errno(syscall.Lchown(cafs.upperPath(path), int(int32(uid)), int(int32(gid))))
+}
+
+// Utimens changes the access and modification times of a file.
+func (cafs *Cafs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	ts := make([]syscall.Timespec, 2)
+	if tmsp == nil {
+		now := fuse.Now()
+		tmsp = []fuse.Timespec{now, now}
+	}
+	for i := range ts {
+		ts[i] = syscall.Timespec{Sec: tmsp[i].Sec, Nsec: tmsp[i].Nsec}
+	}
+	return errno(syscall.UtimesNano(cafs.upperPath(path), ts))
+}
+
+// Truncate changes the size of a file.
+func (cafs *Cafs) Truncate(path string, size int64, fh uint64) (errc int) {
+	if fh != ^uint64(0) && cafs.upper != "" {
+		return errno(syscall.Ftruncate(int(fh), size))
+	}
+	if err := cafs.copyUpWrite(path); err != nil {
+		return errno(err)
+	}
+	return errno(syscall.Truncate(cafs.upperPath(path), size))
+}
+
+// copyUpWrite copies path up for a change, failing with EROFS
+// without an upper directory.
+func (cafs *Cafs) copyUpWrite(path string) error {
+	if cafs.upper == "" {
+		return syscall.EROFS
+	}
+	if cafs.masked(path) {
+		return syscall.ENOENT
+	}
+	return cafs.copyUp(path)
+}
+
+// Write writes data to a file.
+func (cafs *Cafs) Write(path string, buff []byte, offset int64, fh uint64) (n int) {
+	if cafs.upper == "" {
+		// do not write to the pool
+		return -fuse.EROFS
+	}
+	n, e := syscall.Pwrite(int(fh), buff, offset)
+	if e != nil {
+		return errno(e)
+	}
+	return n
+}
+
+// Fsync synchronizes file contents.
+func (cafs *Cafs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	if cafs.upper == "" {
+		return 0
+	}
+	return errno(syscall.Fsync(int(fh)))
+}
+
+// upperXattr returns where the xattrs of path are in the upper
+// directory, empty if they are those in the metadata, and ENOENT for
+// paths hidden by the upper directory.
+func (cafs *Cafs) upperXattr(path string) (upath string, errc int) {
+	if cafs.upper == "" {
+		return "", 0
+	}
+	if cafs.masked(path) {
+		return "", -fuse.ENOENT
+	}
+	if upath = cafs.upperPath(path); exists(upath) {
+		return upath, 0
+	} else if cafs.hidden(path) {
+		return "", -fuse.ENOENT
+	}
+	return "", 0
+}
+
+func isSymlink(path string) bool {
+	stat := syscall.Stat_t{}
+	return syscall.Lstat(path, &stat) == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
+// getxattr returns the value of xattr name of file upath. The xattr
+// syscalls follow symlinks, so symlinks have none here.
+func getxattr(upath, name string) ([]byte, error) {
+	if isSymlink(upath) {
+		return nil, syscall.ENODATA
+	}
+	return xattrBuf(func(b []byte) (int, error) {
+		return syscall.Getxattr(upath, name, b)
+	})
+}
+
+// listxattr returns the names of the xattrs of file upath.
+func listxattr(upath string) ([]string, error) {
+	if isSymlink(upath) {
+		return nil, nil
+	}
+	buf, err := xattrBuf(func(b []byte) (int, error) {
+		return syscall.Listxattr(upath, b)
+	})
+	var names []string
+	for _, name := range strings.Split(string(buf), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, err
+}
+
+// xattrBuf calls get with a buffer large enough for its result, which
+// may grow between calls.
+func xattrBuf(get func(b []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
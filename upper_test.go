@@ -0,0 +1,485 @@
+//go:build darwin || freebsd || netbsd || openbsd || linux
+// +build darwin freebsd netbsd openbsd linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/kaijchen/cafs/metadata"
+)
+
+// newUpperCafs mounts the metadata of a small tree, with its objects in
+// the pool, below an empty upper directory.
+//
+//	/file, with xattr user.test if supported
+//	/link -> file
+//	/dir/a
+//	/dir/sub/b
+//	/empty/
+func newUpperCafs(t *testing.T) *Cafs {
+	root, pool := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"file":      "lower file\n",
+		"dir/a":     "a\n",
+		"dir/sub/b": "b\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Setxattr(filepath.Join(root, "file"), "user.test", []byte("lower"), 0)
+
+	tree := &metadata.Tree{}
+	err := tree.Build(root, func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := testHash(data)
+		if err := os.WriteFile(filepath.Join(pool, hash), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cafs := &Cafs{pool: pool, upper: t.TempDir()}
+	cafs.Overlay = *metadata.NewOverlay(tree)
+	return cafs
+}
+
+func sortedNames(cafs *Cafs, path string) []string {
+	names := cafs.names(path)
+	sort.Strings(names)
+	return names
+}
+
+func readUpper(t *testing.T, cafs *Cafs, path string) string {
+	data, err := os.ReadFile(cafs.upperPath(path))
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestUpperCopyUp(t *testing.T) {
+	cafs := newUpperCafs(t)
+
+	// reading does not copy up
+	errc, fh := cafs.Open("/file", fuse.O_RDONLY)
+	if errc != 0 {
+		t.Fatalf("Open for reading = %d", errc)
+	}
+	cafs.Release("/file", fh)
+	if exists(cafs.upperPath("/file")) {
+		t.Errorf("file copied up by reading")
+	}
+
+	errc, fh = cafs.Open("/file", fuse.O_WRONLY)
+	if errc != 0 {
+		t.Fatalf("Open for writing = %d", errc)
+	}
+	if got := readUpper(t, cafs, "/file"); got != "lower file\n" {
+		t.Errorf("copied up %q", got)
+	}
+	if n := cafs.Write("/file", []byte("upper"), 0, fh); n != 5 {
+		t.Errorf("Write = %d", n)
+	}
+	cafs.Release("/file", fh)
+	if got := readUpper(t, cafs, "/file"); got != "upper file\n" {
+		t.Errorf("written %q", got)
+	}
+
+	// with its parents
+	if errc := cafs.Truncate("/dir/sub/b", 1, ^uint64(0)); errc != 0 {
+		t.Fatalf("Truncate = %d", errc)
+	}
+	if got := readUpper(t, cafs, "/dir/sub/b"); got != "b" {
+		t.Errorf("truncated to %q", got)
+	}
+	errc, fh = cafs.Open("/dir/a", fuse.O_WRONLY|fuse.O_TRUNC)
+	if errc != 0 {
+		t.Fatalf("Open for truncating = %d", errc)
+	}
+	cafs.Release("/dir/a", fh)
+	if got := readUpper(t, cafs, "/dir/a"); got != "" {
+		t.Errorf("truncated to %q", got)
+	}
+
+	stat := syscall.Stat_t{}
+	if cafs.stat("/dir/a", &stat) != nil || stat.Size != 0 {
+		t.Errorf("stat of the copy = %d bytes", stat.Size)
+	}
+	// the metadata is unchanged
+	if cafs.Stat("/dir/a", &stat) != nil || stat.Size != 2 {
+		t.Errorf("stat of the metadata = %d bytes", stat.Size)
+	}
+	if want := []string{".", "..", "a", "sub"}; !reflect.DeepEqual(sortedNames(cafs, "/dir"), want) {
+		t.Errorf("names = %v, want %v", sortedNames(cafs, "/dir"), want)
+	}
+}
+
+func TestUpperRemove(t *testing.T) {
+	cafs := newUpperCafs(t)
+	stat := syscall.Stat_t{}
+
+	if errc := cafs.Unlink("/file"); errc != 0 {
+		t.Fatalf("Unlink = %d", errc)
+	}
+	if !exists(cafs.whiteoutPath("/file")) {
+		t.Errorf("no whiteout of unlinked file")
+	}
+	if cafs.stat("/file", &stat) != syscall.ENOENT {
+		t.Errorf("unlinked file still there")
+	}
+	if errc := cafs.Unlink("/file"); errc != -fuse.ENOENT {
+		t.Errorf("Unlink again = %d", errc)
+	}
+
+	if errc := cafs.Rmdir("/dir"); errc != -fuse.ENOTEMPTY {
+		t.Errorf("Rmdir of non-empty directory = %d", errc)
+	}
+	for _, path := range []string{"/dir/a", "/dir/sub/b"} {
+		if errc := cafs.Unlink(path); errc != 0 {
+			t.Fatalf("Unlink %s = %d", path, errc)
+		}
+	}
+	for _, path := range []string{"/dir/sub", "/dir"} {
+		if errc := cafs.Rmdir(path); errc != 0 {
+			t.Fatalf("Rmdir %s = %d", path, errc)
+		}
+	}
+	if exists(cafs.upperPath("/dir")) || !exists(cafs.whiteoutPath("/dir")) {
+		t.Errorf("removed directory not replaced by a whiteout")
+	}
+	if cafs.stat("/dir/a", &stat) != syscall.ENOENT {
+		t.Errorf("file in removed directory still there")
+	}
+
+	// only in the upper directory, so there is nothing to hide
+	if errc, fh := cafs.Create("/new", fuse.O_WRONLY, 0644); errc != 0 {
+		t.Fatalf("Create = %d", errc)
+	} else {
+		syscall.Close(int(fh))
+	}
+	if errc := cafs.Unlink("/new"); errc != 0 {
+		t.Fatalf("Unlink = %d", errc)
+	}
+	if exists(cafs.whiteoutPath("/new")) {
+		t.Errorf("whiteout of file only in the upper directory")
+	}
+
+	if want := []string{".", "..", "empty", "link"}; !reflect.DeepEqual(sortedNames(cafs, "/"), want) {
+		t.Errorf("names = %v, want %v", sortedNames(cafs, "/"), want)
+	}
+}
+
+func TestUpperRmdirRace(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, metadata.WhiteoutPrefix+"a")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// created after Rmdir found the directory empty
+	if err := os.WriteFile(filepath.Join(dir, "b"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rmdir(dir); err != syscall.ENOTEMPTY && err != syscall.EEXIST {
+		t.Errorf("rmdir = %v, want ENOTEMPTY", err)
+	}
+	if !exists(marker) || !exists(filepath.Join(dir, "b")) {
+		t.Errorf("rmdir lost entries of the directory")
+	}
+}
+
+func TestUpperOpaque(t *testing.T) {
+	cafs := newUpperCafs(t)
+	for _, path := range []string{"/dir/a", "/dir/sub/b"} {
+		if errc := cafs.Unlink(path); errc != 0 {
+			t.Fatalf("Unlink %s = %d", path, errc)
+		}
+	}
+	for _, path := range []string{"/dir/sub", "/dir", "/empty"} {
+		if errc := cafs.Rmdir(path); errc != 0 {
+			t.Fatalf("Rmdir %s = %d", path, errc)
+		}
+	}
+
+	if errc := cafs.Mkdir("/dir", 0755); errc != 0 {
+		t.Fatalf("Mkdir = %d", errc)
+	}
+	if exists(cafs.whiteoutPath("/dir")) {
+		t.Errorf("whiteout of recreated directory kept")
+	}
+	if !exists(filepath.Join(cafs.upperPath("/dir"), metadata.OpaqueMarker)) {
+		t.Errorf("recreated directory not opaque")
+	}
+	if want := []string{".", ".."}; !reflect.DeepEqual(sortedNames(cafs, "/dir"), want) {
+		t.Errorf("names = %v, want %v", sortedNames(cafs, "/dir"), want)
+	}
+	stat := syscall.Stat_t{}
+	if cafs.stat("/dir/sub", &stat) != syscall.ENOENT {
+		t.Errorf("directory of the metadata shows through opaque directory")
+	}
+
+	// a new directory is not opaque
+	if errc := cafs.Mkdir("/new", 0755); errc != 0 {
+		t.Fatalf("Mkdir = %d", errc)
+	}
+	if exists(filepath.Join(cafs.upperPath("/new"), metadata.OpaqueMarker)) {
+		t.Errorf("new directory opaque")
+	}
+}
+
+func TestUpperRename(t *testing.T) {
+	cafs := newUpperCafs(t)
+	tests := []struct {
+		oldpath, newpath string
+		errc             int
+	}{
+		// directories of the metadata are copied by the caller
+		{"/dir", "/moved", -fuse.EXDEV},
+		{"/file", "/empty", -fuse.EXDEV},
+		{"/missing", "/moved", -fuse.ENOENT},
+		{"/file", "/moved", 0},
+		{"/link", "/dir/link", 0},
+	}
+	for _, tt := range tests {
+		if errc := cafs.Rename(tt.oldpath, tt.newpath); errc != tt.errc {
+			t.Errorf("Rename(%s, %s) = %d, want %d", tt.oldpath, tt.newpath, errc, tt.errc)
+		}
+	}
+	if got := readUpper(t, cafs, "/moved"); got != "lower file\n" {
+		t.Errorf("renamed file has %q", got)
+	}
+	if !exists(cafs.whiteoutPath("/file")) || !exists(cafs.whiteoutPath("/link")) {
+		t.Errorf("no whiteout of renamed file")
+	}
+	if errc, target := cafs.Readlink("/dir/link"); errc != 0 || target != "file" {
+		t.Errorf("Readlink = %d, %q", errc, target)
+	}
+
+	// directories only in the upper directory are renamed
+	if errc := cafs.Mkdir("/new", 0755); errc != 0 {
+		t.Fatalf("Mkdir = %d", errc)
+	}
+	if errc := cafs.Rename("/new", "/newer"); errc != 0 {
+		t.Errorf("Rename of new directory = %d", errc)
+	}
+	if want := []string{".", "..", "dir", "empty", "moved", "newer"}; !reflect.DeepEqual(sortedNames(cafs, "/"), want) {
+		t.Errorf("names = %v, want %v", sortedNames(cafs, "/"), want)
+	}
+}
+
+func TestUpperNames(t *testing.T) {
+	cafs := newUpperCafs(t)
+	if errc, fh := cafs.Create("/dir/c", fuse.O_WRONLY, 0644); errc != 0 {
+		t.Fatalf("Create = %d", errc)
+	} else {
+		syscall.Close(int(fh))
+	}
+	if errc := cafs.Unlink("/dir/a"); errc != 0 {
+		t.Fatalf("Unlink = %d", errc)
+	}
+	// in both, listed once
+	if errc := cafs.Truncate("/dir/sub/b", 0, ^uint64(0)); errc != 0 {
+		t.Fatalf("Truncate = %d", errc)
+	}
+	tests := []struct {
+		path  string
+		names []string
+	}{
+		{"/", []string{".", "..", "dir", "empty", "file", "link"}},
+		{"/dir", []string{".", "..", "c", "sub"}},
+		{"/dir/sub", []string{".", "..", "b"}},
+		{"/empty", []string{".", ".."}},
+	}
+	for _, tt := range tests {
+		if got := sortedNames(cafs, tt.path); !reflect.DeepEqual(got, tt.names) {
+			t.Errorf("names(%s) = %v, want %v", tt.path, got, tt.names)
+		}
+	}
+	if errc, _ := cafs.Create("/dir/"+metadata.WhiteoutPrefix+"a", fuse.O_WRONLY, 0644); errc != -fuse.EINVAL {
+		t.Errorf("Create of a marker = %d, want EINVAL", errc)
+	}
+}
+
+func TestUpperMarkers(t *testing.T) {
+	cafs := newUpperCafs(t)
+	if errc := cafs.Unlink("/file"); errc != 0 {
+		t.Fatalf("Unlink = %d", errc)
+	}
+	// recreated, so made opaque
+	if errc := cafs.Unlink("/dir/sub/b"); errc != 0 {
+		t.Fatalf("Unlink = %d", errc)
+	}
+	if errc := cafs.Rmdir("/dir/sub"); errc != 0 {
+		t.Fatalf("Rmdir = %d", errc)
+	}
+	if errc := cafs.Mkdir("/dir/sub", 0755); errc != 0 {
+		t.Fatalf("Mkdir = %d", errc)
+	}
+	whiteout := "/" + metadata.WhiteoutPrefix + "file"
+	opaque := "/dir/sub/" + metadata.OpaqueMarker
+
+	// markers cannot be reached by name, so cannot be undone
+	for _, path := range []string{whiteout, opaque} {
+		stat := fuse.Stat_t{}
+		if errc := cafs.Getattr(path, &stat, ^uint64(0)); errc != -fuse.ENOENT {
+			t.Errorf("Getattr(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc, _ := cafs.Open(path, fuse.O_RDONLY); errc != -fuse.ENOENT {
+			t.Errorf("Open(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc, _ := cafs.Readlink(path); errc != -fuse.ENOENT {
+			t.Errorf("Readlink(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc, _ := cafs.Getxattr(path, "user.a"); errc != -fuse.ENOENT {
+			t.Errorf("Getxattr(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc := cafs.Chmod(path, 0600); errc != -fuse.ENOENT {
+			t.Errorf("Chmod(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc := cafs.Unlink(path); errc != -fuse.ENOENT {
+			t.Errorf("Unlink(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc := cafs.Rename(path, "/moved"); errc != -fuse.ENOENT {
+			t.Errorf("Rename(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc := cafs.Link(path, "/linked"); errc != -fuse.ENOENT {
+			t.Errorf("Link(%s) = %d, want ENOENT", path, errc)
+		}
+		if errc, _ := cafs.Create(path+"/x", fuse.O_WRONLY, 0644); errc != -fuse.ENOENT {
+			t.Errorf("Create below %s = %d, want ENOENT", path, errc)
+		}
+	}
+	if !exists(cafs.whiteoutPath("/file")) || !exists(cafs.upperPath(opaque)) {
+		t.Fatalf("markers removed")
+	}
+	stat := syscall.Stat_t{}
+	if cafs.stat("/file", &stat) != syscall.ENOENT {
+		t.Errorf("unlinked file visible again")
+	}
+	if want := []string{".", ".."}; !reflect.DeepEqual(sortedNames(cafs, "/dir/sub"), want) {
+		t.Errorf("names = %v, want %v", sortedNames(cafs, "/dir/sub"), want)
+	}
+}
+
+func TestUpperXattr(t *testing.T) {
+	cafs := newUpperCafs(t)
+	if errc, _ := cafs.Getxattr("/file", "user.test"); errc != 0 {
+		t.Skipf("xattrs not supported: %d", errc)
+	}
+
+	// kept by copy-up
+	if errc := cafs.Chmod("/file", 0600); errc != 0 {
+		t.Fatalf("Chmod = %d", errc)
+	}
+	if value, err := getxattr(cafs.upperPath("/file"), "user.test"); err != nil || string(value) != "lower" {
+		t.Errorf("copied up xattr = %q, %v", value, err)
+	}
+
+	if errc := cafs.Setxattr("/file", "user.new", []byte("upper"), 0); errc != 0 {
+		t.Fatalf("Setxattr = %d", errc)
+	}
+	var names []string
+	errc := cafs.Listxattr("/file", func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	sort.Strings(names)
+	if want := []string{"user.new", "user.test"}; errc != 0 || !reflect.DeepEqual(names, want) {
+		t.Errorf("Listxattr = %v, %d, want %v", names, errc, want)
+	}
+	if errc := cafs.Removexattr("/file", "user.test"); errc != 0 {
+		t.Fatalf("Removexattr = %d", errc)
+	}
+	if errc, _ := cafs.Getxattr("/file", "user.test"); errc != -fuse.ENOATTR {
+		t.Errorf("Getxattr of removed xattr = %d, want ENOATTR", errc)
+	}
+	if errc, value := cafs.Getxattr("/file", "user.new"); errc != 0 || string(value) != "upper" {
+		t.Errorf("Getxattr = %q, %d", value, errc)
+	}
+
+	// setting copies up, leaving the metadata alone
+	if errc := cafs.Setxattr("/dir/a", "user.new", []byte("upper"), 0); errc != 0 {
+		t.Fatalf("Setxattr = %d", errc)
+	}
+	if !exists(cafs.upperPath("/dir/a")) {
+		t.Errorf("file not copied up by Setxattr")
+	}
+	if _, errc := cafs.GetXattr("/dir/a", "user.new"); errc != -fuse.ENOATTR {
+		t.Errorf("xattr set in the metadata")
+	}
+
+	cafs.upper = ""
+	if errc := cafs.Setxattr("/file", "user.new", nil, 0); errc != -fuse.EROFS {
+		t.Errorf("Setxattr without upper directory = %d, want EROFS", errc)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	cafs := newUpperCafs(t)
+	errc, fh := cafs.Opendir("/")
+	if errc != 0 {
+		t.Fatalf("Opendir = %d", errc)
+	}
+	defer cafs.Releasedir("/", fh)
+	// not in the snapshot
+	if errc := cafs.Mkdir("/new", 0755); errc != 0 {
+		t.Fatalf("Mkdir = %d", errc)
+	}
+	var names []string
+	fill := func(name string, stat *fuse.Stat_t, offset int64) bool {
+		if name == "file" && (stat == nil || stat.Mode&fuse.S_IFMT != fuse.S_IFREG) {
+			t.Errorf("stat of file = %v", stat)
+		}
+		names = append(names, name)
+		// stop halfway, to be resumed
+		return len(names) != 3
+	}
+	if errc := cafs.Readdir("/", fill, 0, fh); errc != 0 {
+		t.Fatalf("Readdir = %d", errc)
+	}
+	if errc := cafs.Readdir("/", fill, 3, fh); errc != 0 {
+		t.Fatalf("Readdir = %d", errc)
+	}
+	if want := []string{".", "..", "dir", "empty", "file", "link"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdir = %v, want %v", names, want)
+	}
+}
+
+func TestUpperStatfs(t *testing.T) {
+	cafs := newUpperCafs(t)
+	stat := fuse.Statfs_t{}
+	if errc := cafs.Statfs("/", &stat); errc != 0 {
+		t.Fatalf("Statfs = %d", errc)
+	}
+	// writes go to the upper directory, whatever the pool has
+	stgo := syscall.Statfs_t{}
+	if err := syscall.Statfs(cafs.upper, &stgo); err != nil {
+		t.Fatal(err)
+	}
+	if stgo.Bavail > 0 && stat.Bavail == 0 {
+		t.Errorf("no free space reported for the upper directory")
+	}
+}